@@ -0,0 +1,184 @@
+package justgrep
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFileCache is used by FetchForDate to keep finished log files on disk, nil disables caching.
+var LogFileCache *LogCache
+
+// LogCache stores gzipped justlog files in a directory. Files are named after a hash of their URL, which includes the
+// instance URL. When the total size exceeds MaxSize, least recently used files are removed.
+type LogCache struct {
+	Dir string
+	// MaxSize is in bytes, 0 means no limit
+	MaxSize int64
+
+	lock sync.Mutex
+}
+
+// NewLogCache creates the cache directory if it doesn't exist.
+func NewLogCache(dir string, maxSize int64) (*LogCache, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &LogCache{Dir: dir, MaxSize: maxSize}, nil
+}
+
+func (c *LogCache) path(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+".gz")
+}
+
+// Open returns a reader with the decompressed contents of the cached file or nil if url isn't cached.
+func (c *LogCache) Open(url string) io.ReadCloser {
+	path := c.path(url)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return nil
+	}
+	// mark as recently used for eviction
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return &cacheReader{Reader: reader, file: file}
+}
+
+type cacheReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *cacheReader) Close() error {
+	_ = r.Reader.Close()
+	return r.file.Close()
+}
+
+// Create returns a writer for url. Data written to it only becomes visible after calling Commit, Abort throws it away.
+func (c *LogCache) Create(url string) (*CacheWriter, error) {
+	file, err := os.CreateTemp(c.Dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	return &CacheWriter{
+		Writer: gzip.NewWriter(file),
+		cache:  c,
+		file:   file,
+		path:   c.path(url),
+	}, nil
+}
+
+type CacheWriter struct {
+	*gzip.Writer
+	cache *LogCache
+	file  *os.File
+	path  string
+}
+
+// Commit makes the file available in the cache and evicts old files if needed.
+func (w *CacheWriter) Commit() error {
+	err := w.Writer.Close()
+	if err == nil {
+		err = w.file.Close()
+	} else {
+		_ = w.file.Close()
+	}
+	if err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+	err = os.Rename(w.file.Name(), w.path)
+	if err != nil {
+		_ = os.Remove(w.file.Name())
+		return err
+	}
+	return w.cache.evict()
+}
+
+// Abort removes the incomplete file.
+func (w *CacheWriter) Abort() {
+	_ = w.Writer.Close()
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+// staleTempAge is how long a file being written hasn't been touched before it's considered left behind by a crash
+const staleTempAge = time.Hour
+
+// evict removes least recently used files until the cache fits in MaxSize, as well as stale temporary files.
+func (c *LogCache) evict() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	var total int64
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			info, err := entry.Info()
+			if err == nil && time.Since(info.ModTime()) > staleTempAge {
+				_ = os.Remove(filepath.Join(c.Dir, entry.Name()))
+			}
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), ".gz") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// removed in the meantime
+			continue
+		}
+		total += info.Size()
+		files = append(files, info)
+	}
+	if c.MaxSize == 0 {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if total <= c.MaxSize {
+			break
+		}
+		err := os.Remove(filepath.Join(c.Dir, file.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= file.Size()
+	}
+	return nil
+}
+
+// isFinished tells if the log file starting at date can't get new messages anymore.
+func isFinished(api JustlogAPI, date time.Time, now time.Time) bool {
+	var end time.Time
+	if api.GetApproximateOffset() >= 24*time.Hour*28 {
+		end = date.AddDate(0, 1, 0)
+	} else {
+		end = date.AddDate(0, 0, 1)
+	}
+	// leave some room for clock skew and messages written right before midnight
+	return now.After(end.Add(time.Hour))
+}
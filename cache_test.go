@@ -0,0 +1,133 @@
+package justgrep
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeCached(t *testing.T, c *LogCache, url string, data string) {
+	w, err := c.Create(url)
+	assert(t, "create err", err, nil)
+	_, err = io.WriteString(w, data)
+	assert(t, "write err", err, nil)
+	assert(t, "commit err", w.Commit(), nil)
+}
+
+func TestLogCache(t *testing.T) {
+	c, err := NewLogCache(t.TempDir(), 0)
+	assert(t, "err", err, nil)
+
+	if c.Open("http://a/channel/x/2022/1/1") != nil {
+		t.Errorf("expected a miss on an empty cache")
+	}
+	writeCached(t, c, "http://a/channel/x/2022/1/1", "line 1\nline 2\n")
+	reader := c.Open("http://a/channel/x/2022/1/1")
+	if reader == nil {
+		t.Fatalf("expected a hit")
+	}
+	data, err := io.ReadAll(reader)
+	assert(t, "read err", err, nil)
+	assert(t, "data", string(data), "line 1\nline 2\n")
+	assert(t, "close err", reader.Close(), nil)
+
+	if c.Open("http://b/channel/x/2022/1/1") != nil {
+		t.Errorf("expected a miss for a different instance")
+	}
+
+	w, err := c.Create("http://a/channel/x/2022/1/2")
+	assert(t, "create err", err, nil)
+	_, _ = io.WriteString(w, "partial")
+	w.Abort()
+	if c.Open("http://a/channel/x/2022/1/2") != nil {
+		t.Errorf("expected aborted files not to be cached")
+	}
+	entries, _ := os.ReadDir(c.Dir)
+	assert(t, "files in cache dir", len(entries), 1)
+}
+
+func TestLogCache_Evict(t *testing.T) {
+	c, err := NewLogCache(t.TempDir(), 0)
+	assert(t, "err", err, nil)
+	data := strings.Repeat("x", 1000)
+	old := time.Now().Add(-time.Hour)
+	for _, url := range []string{"1", "2", "3"} {
+		writeCached(t, c, url, data)
+		_ = os.Chtimes(c.path(url), old, old)
+		old = old.Add(time.Minute)
+	}
+	// use the oldest one, it should survive
+	_ = c.Open("1").Close()
+
+	info, err := os.Stat(c.path("1"))
+	assert(t, "stat err", err, nil)
+	c.MaxSize = info.Size() * 2
+	assert(t, "evict err", c.evict(), nil)
+
+	matches, _ := filepath.Glob(filepath.Join(c.Dir, "*.gz"))
+	assert(t, "files left", len(matches), 2)
+	if c.Open("2") != nil {
+		t.Errorf("expected the least recently used file to be evicted")
+	}
+}
+
+func TestLogCache_EvictStaleTemporaryFiles(t *testing.T) {
+	c, err := NewLogCache(t.TempDir(), 0)
+	assert(t, "err", err, nil)
+	stale, err := os.CreateTemp(c.Dir, ".tmp-")
+	assert(t, "err", err, nil)
+	_ = stale.Close()
+	old := time.Now().Add(-2 * staleTempAge)
+	_ = os.Chtimes(stale.Name(), old, old)
+	running, err := c.Create("running")
+	assert(t, "err", err, nil)
+
+	writeCached(t, c, "1", "data")
+	matches, _ := filepath.Glob(filepath.Join(c.Dir, ".tmp-*"))
+	assert(t, "temporary files left", len(matches), 1)
+	running.Abort()
+}
+
+func TestLogCache_AbortOnCancel(t *testing.T) {
+	c, err := NewLogCache(t.TempDir(), 0)
+	assert(t, "err", err, nil)
+	w, err := c.Create("1")
+	assert(t, "err", err, nil)
+	body := io.NopCloser(strings.NewReader(strings.Repeat("@tmi-sent-ts=1640995200000 :a!a@a PRIVMSG #test :x\n", 100)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	output := make(chan *Message)
+	progress := &ProgressState{TotalResults: make([]int, ResultCount)}
+	go readMessages(ctx, "1", body, output, progress, w, nil)
+	<-output
+	// nothing reads the rest
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		matches, _ := filepath.Glob(filepath.Join(c.Dir, ".tmp-*"))
+		if len(matches) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the cancelled download to be removed from the cache, found %v", matches)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if c.Open("1") != nil {
+		t.Errorf("expected cancelled downloads not to be cached")
+	}
+}
+
+func TestIsFinished(t *testing.T) {
+	now := time.Date(2022, 3, 15, 12, 0, 0, 0, time.UTC)
+	channel := ChannelJustlogAPI{}
+	user := UserJustlogAPI{}
+	assert(t, "yesterday", isFinished(channel, time.Date(2022, 3, 14, 0, 0, 0, 0, time.UTC), now), true)
+	assert(t, "today", isFinished(channel, time.Date(2022, 3, 15, 0, 0, 0, 0, time.UTC), now), false)
+	assert(t, "last month", isFinished(user, time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC), now), true)
+	assert(t, "this month", isFinished(user, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), now), false)
+}
@@ -1,30 +1,97 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/Mm2PL/justgrep"
 )
 
+// parseFailure is written instead of a message with -on-error passthrough
+type parseFailure struct {
+	Error string `json:"error"`
+	Raw   string `json:"raw"`
+	Line  int    `json:"line"`
+}
+
+// twitchMessage adds the typed Twitch fields with -twitch
+type twitchMessage struct {
+	*justgrep.Message
+	Twitch justgrep.TwitchFields `json:"twitch"`
+}
+
 func main() {
-	scanner := bufio.NewScanner(os.Stdin)
+	onError := flag.String(
+		"on-error",
+		"stop",
+		"What to do with lines that can't be parsed: stop, skip (report them on stderr and continue) "+
+			"or passthrough (output {\"error\": ..., \"raw\": ..., \"line\": ...} instead)",
+	)
+	summary := flag.Bool(
+		"summary",
+		false,
+		"At the end, write a JSON object with counts of lines per command and per parse error to stderr",
+	)
+	twitch := flag.Bool(
+		"twitch",
+		false,
+		"Add a \"twitch\" object with parsed badges, emotes, bits, reply and other fields from the Twitch tags",
+	)
+	flag.Parse()
+	if *onError != "stop" && *onError != "skip" && *onError != "passthrough" {
+		_, _ = fmt.Fprintln(os.Stderr, "-on-error needs to be one of stop, skip or passthrough.")
+		os.Exit(1)
+	}
+
+	lines := justgrep.NewLineReader(os.Stdin)
 	encoder := json.NewEncoder(os.Stdout)
+	stats := justgrep.NewParseStats()
+	exit := func(code int) {
+		if *summary {
+			_ = json.NewEncoder(os.Stderr).Encode(stats)
+		}
+		os.Exit(code)
+	}
 
 	i := 0
-	for scanner.Scan() {
+	for {
+		line, err := lines.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != justgrep.ErrLineTooLong {
+			_, _ = fmt.Fprintf(os.Stderr, "Line %d: Failed to read input: %s\n", i+1, err)
+			exit(1)
+		}
 		i += 1
-		msg, err := justgrep.NewMessage(scanner.Text())
+		var msg *justgrep.Message
+		if err == nil {
+			msg, err = justgrep.NewMessage(line)
+		}
+		stats.Add(msg, err)
 		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Line %d: Failed to irc parse message: %s\n", i, err)
-			os.Exit(1)
+			switch *onError {
+			case "stop":
+				_, _ = fmt.Fprintf(os.Stderr, "Line %d: Failed to irc parse message: %s\n", i, err)
+				exit(1)
+			case "skip":
+				_, _ = fmt.Fprintf(os.Stderr, "Line %d: Failed to irc parse message: %s\n", i, err)
+				continue
+			case "passthrough":
+				err = encoder.Encode(parseFailure{Error: err.Error(), Raw: line, Line: i})
+			}
+		} else if *twitch {
+			err = encoder.Encode(twitchMessage{Message: msg, Twitch: msg.Twitch()})
+		} else {
+			err = encoder.Encode(msg)
 		}
-		err = encoder.Encode(msg)
 		if err != nil {
 			_, _ = fmt.Fprintf(os.Stderr, "Failed to JSON encode message: %s\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 	}
+	exit(0)
 }
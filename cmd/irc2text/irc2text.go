@@ -1,40 +1,99 @@
 package main
 
 import (
-	"bufio"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/Mm2PL/justgrep"
 )
 
 func main() {
-	scanner := bufio.NewScanner(os.Stdin)
+	hideUnknown := flag.Bool(
+		"hide-unknown",
+		false,
+		"Skip IRC commands irc2text doesn't know instead of printing the command and its arguments",
+	)
+	timeZone := flag.String("tz", "UTC", "Time zone to show timestamps in, an IANA name like Europe/Warsaw or local")
+	timeFormat := flag.String(
+		"time-format",
+		"2006-01-02 15:04:05",
+		"Go time layout or rfc3339, unix, unixms or relative (to the first message)",
+	)
+	noTime := flag.Bool("no-time", false, "Don't show timestamps")
+	onError := flag.String(
+		"on-error",
+		"stop",
+		"What to do with lines that can't be parsed: stop, skip (report them on stderr and continue) "+
+			"or passthrough (print them unchanged)",
+	)
+	summary := flag.Bool(
+		"summary",
+		false,
+		"At the end, write counts of lines per command and per parse error to stderr",
+	)
+	flag.Parse()
+	if *onError != "stop" && *onError != "skip" && *onError != "passthrough" {
+		_, _ = fmt.Fprintln(os.Stderr, "-on-error needs to be one of stop, skip or passthrough.")
+		os.Exit(1)
+	}
+	location, err := justgrep.ParseTimeZone(*timeZone)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "-tz: %s\n", err)
+		os.Exit(1)
+	}
+	opts := justgrep.RenderOptions{
+		HideUnknown: *hideUnknown,
+		Location:    location,
+		TimeFormat:  *timeFormat,
+		NoTime:      *noTime,
+	}
+	lines := justgrep.NewLineReader(os.Stdin)
+	stats := justgrep.NewParseStats()
+	exit := func(code int) {
+		if *summary {
+			stats.WriteText(os.Stderr)
+		}
+		os.Exit(code)
+	}
 
-	for scanner.Scan() {
-		msg, err := justgrep.NewMessage(scanner.Text())
-		if err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Failed to irc parse message: %s\n", err)
-			os.Exit(1)
+	i := 0
+	first := true
+	for {
+		line, err := lines.Next()
+		if err == io.EOF {
+			break
 		}
-		if msg.Action == "PRIVMSG" {
-			fmt.Printf("[%s] %s ", msg.Timestamp.UTC().Format("2006-01-02 15:04:05"), msg.Args[0])
-			fmt.Printf("%s: %s\n", msg.User, msg.Args[1])
-		} else if msg.Action == "NOTICE" {
-			fmt.Printf("[%s] %s ", msg.Timestamp.UTC().Format("2006-01-02 15:04:05"), msg.Args[0])
-			fmt.Printf("NOTICE %s\n", msg.Args[1])
-		} else if msg.Action == "CLEARCHAT" {
-			fmt.Printf("[%s] %s ", msg.Timestamp.UTC().Format("2006-01-02 15:04:05"), msg.Args[0])
-			if len(msg.Args) < 2 {
-				fmt.Println("Chat has been cleared")
-			} else {
-				duration := msg.Tags["ban-duration"]
-				if duration == "" {
-					fmt.Printf("%s was permanently banned\n", msg.Args[1])
-				} else {
-					fmt.Printf("%s was timed out for %s seconds\n", msg.Args[1], duration)
-				}
+		if err != nil && err != justgrep.ErrLineTooLong {
+			_, _ = fmt.Fprintf(os.Stderr, "Line %d: Failed to read input: %s\n", i+1, err)
+			exit(1)
+		}
+		i += 1
+		var msg *justgrep.Message
+		if err == nil {
+			msg, err = justgrep.NewMessage(line)
+		}
+		stats.Add(msg, err)
+		if err != nil {
+			switch *onError {
+			case "stop":
+				_, _ = fmt.Fprintf(os.Stderr, "Line %d: Failed to irc parse message: %s\n", i, err)
+				exit(1)
+			case "skip":
+				_, _ = fmt.Fprintf(os.Stderr, "Line %d: Failed to irc parse message: %s\n", i, err)
+			case "passthrough":
+				fmt.Println(line)
 			}
+			continue
+		}
+		if first {
+			opts.RelativeTo = msg.Timestamp
+			first = false
+		}
+		if text, ok := justgrep.RenderTextWith(msg, opts); ok {
+			fmt.Println(text)
 		}
 	}
+	exit(0)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Mm2PL/justgrep"
+)
+
+func main() {
+	rebuild := flag.Bool("rebuild", false, "Always rebuild lines from the structured fields, ignoring raw")
+	verify := flag.Bool(
+		"verify",
+		false,
+		"Check that every line parses back into the same message and fail if it doesn't",
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: json2irc [-rebuild] [-verify] < messages.json\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"A changed user replaces the whole prefix of Twitch messages, user!user@user.tmi.twitch.tv.\n"+
+				"Other prefixes only get a new nick and keep the old user and host parts. Check man page for details\n",
+		)
+	}
+	flag.Parse()
+	decoder := json.NewDecoder(os.Stdin)
+
+	i := 0
+	for {
+		i += 1
+		var data json.RawMessage
+		err := decoder.Decode(&data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Message %d: Failed to JSON decode message: %s\n", i, err)
+			os.Exit(1)
+		}
+		msg, err := justgrep.MessageFromJSON(data)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Message %d: Failed to JSON decode message: %s\n", i, err)
+			os.Exit(1)
+		}
+		if *rebuild {
+			msg.Rebuild()
+		}
+		if *verify {
+			err = justgrep.VerifyRoundTrip(msg)
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Message %d: Round trip failed: %s\n", i, err)
+				os.Exit(1)
+			}
+		}
+		fmt.Println(msg.Raw)
+	}
+}
@@ -1,16 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/Mm2PL/justgrep"
@@ -27,19 +35,40 @@ type progressUpdate struct {
 	CurrentChannelNum int `json:"current_channel_num,omitempty"`
 	CountChannels     int `json:"count_channels,omitempty"`
 
-	Progress justgrep.ProgressState `json:"progress"`
+	// Progress covers all channels, ChannelProgress is only about the current one
+	Progress        justgrep.ProgressState `json:"progress"`
+	ChannelProgress justgrep.ProgressState `json:"channel_progress"`
 }
 
 type errorReport struct {
-	Type     string                 `json:"type"`
-	Error    string                 `json:"error"`
-	Progress justgrep.ProgressState `json:"progress"`
+	Type            string                 `json:"type"`
+	Error           string                 `json:"error"`
+	Progress        justgrep.ProgressState `json:"progress"`
+	ChannelProgress justgrep.ProgressState `json:"channel_progress"`
+}
+
+// retryReport is sent for fetchRetry and fetchFailed
+type retryReport struct {
+	Type    string  `json:"type"`
+	URL     string  `json:"url"`
+	Attempt int     `json:"attempt,omitempty"`
+	Delay   float64 `json:"delay,omitempty"`
+	Error   string  `json:"error"`
 }
 
 type summaryReport struct {
 	Type     string                 `json:"type"`
 	Results  map[string]int         `json:"results"`
 	Progress justgrep.ProgressState `json:"progress"`
+	Failed   []failedLog            `json:"failed"`
+}
+
+// failedLog is a log file which couldn't be searched completely
+type failedLog struct {
+	Channel string `json:"channel"`
+	// Date is empty if the log files of the channel couldn't be listed
+	Date  string `json:"date,omitempty"`
+	Error string `json:"error"`
 }
 
 type arguments struct {
@@ -51,16 +80,34 @@ type arguments struct {
 
 	channel      *string
 	messageRegex *string
+	query        *string
 	maxResults   *int
 
+	patternsFile       *string
+	patternsMode       *string
+	patternsIgnoreCase *bool
+	showPattern        *bool
+
 	msgOnly *bool
 
+	countBy   *string
+	countOnly *bool
+	counter   *justgrep.Counter
+
+	contextBefore *int
+	contextAfter  *int
+	contextBoth   *int
+
 	start *string
 	end   *string
 
 	startTime time.Time
 	endTime   time.Time
 
+	jobs          *int
+	channelJobs   *int
+	channelOutput *string
+
 	verbose      *bool
 	recursive    *bool
 	progressJson *bool
@@ -68,13 +115,57 @@ type arguments struct {
 	messageTypes    []string
 	messageTypesRaw *string
 
+	tags    []justgrep.TagPredicate
+	tagsRaw stringList
+
 	noEnv *bool
+
+	dir *string
+
+	federated     *bool
+	showInstances *bool
+
+	format      *string
+	templateRaw *string
+	template    *template.Template
+	colorRaw    *string
+	// color is -color resolved against stdout
+	color bool
+
+	timeZone   *string
+	location   *time.Location
+	timeFormat *string
+	noTime     *bool
+
+	cacheDir  *string
+	cacheSize *int
+	noCache   *bool
+
+	retries       *int
+	retryDelay    *time.Duration
+	retryMaxDelay *time.Duration
+	onError       *string
 }
 
-func parseTime(input string) (output time.Time, err error) {
-	output, err = time.Parse("2006-01-02 15:04:05", input)
-	if err == nil {
-		return
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseTime parses -start and -end, times without an offset are in location
+func parseTime(input string, location *time.Location) (output time.Time, err error) {
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		output, err = time.ParseInLocation(layout, input, location)
+		if err == nil {
+			return
+		}
 	}
 	output, err = time.Parse("2006-01-02 15:04:05-07:00", input)
 	if err == nil {
@@ -106,21 +197,151 @@ func (args *arguments) validateAndProcessFlags() (valid bool) {
 		_, _ = fmt.Fprintln(os.Stderr, "Passing both -v and -progress-json doesn't make sense because they use stderr.")
 		valid = false
 	}
+	if *args.patternsMode != "fixed" && *args.patternsMode != "regex" {
+		_, _ = fmt.Fprintln(os.Stderr, "-patterns-mode needs to be either fixed or regex.")
+		valid = false
+	}
+	if *args.showPattern && *args.patternsFile == "" {
+		_, _ = fmt.Fprintln(os.Stderr, "-show-pattern doesn't make sense without -patterns-file.")
+		valid = false
+	}
+	if *args.jobs < 1 {
+		_, _ = fmt.Fprintln(os.Stderr, "-j needs to be at least 1.")
+		valid = false
+	}
+	if *args.dir != "" && *args.url != "" {
+		_, _ = fmt.Fprintln(os.Stderr, "Passing both -dir and -url doesn't make sense.")
+		valid = false
+	}
+	if *args.federated && *args.dir != "" {
+		_, _ = fmt.Fprintln(os.Stderr, "-federated searches justlog instances, it can't be used with -dir.")
+		valid = false
+	}
+	if *args.showInstances && !*args.federated {
+		_, _ = fmt.Fprintln(os.Stderr, "-show-instances doesn't make sense without -federated.")
+		valid = false
+	}
+	if *args.cacheSize < 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "-cache-size can't be negative.")
+		valid = false
+	}
+	if *args.retries < 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "-retries can't be negative.")
+		valid = false
+	}
+	if *args.retryDelay < 0 || *args.retryMaxDelay < 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "-retry-delay and -retry-max-delay can't be negative.")
+		valid = false
+	}
+	if *args.onError != "stop" && *args.onError != "skip" && *args.onError != "retry" {
+		_, _ = fmt.Fprintln(os.Stderr, "-on-error needs to be one of stop, skip or retry.")
+		valid = false
+	}
+	if *args.channelJobs < 1 {
+		_, _ = fmt.Fprintln(os.Stderr, "-channel-jobs needs to be at least 1.")
+		valid = false
+	}
+	if *args.channelOutput != "grouped" && *args.channelOutput != "interleaved" {
+		_, _ = fmt.Fprintln(os.Stderr, "-channel-output needs to be either grouped or interleaved.")
+		valid = false
+	}
+	switch *args.format {
+	case "raw", "json", "text", "csv":
+		if *args.templateRaw != "" {
+			_, _ = fmt.Fprintln(os.Stderr, "-template needs -format template.")
+			valid = false
+		}
+	case "template":
+		tmpl, err := template.New("-template").Parse(*args.templateRaw)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-template: %s\n", err)
+			valid = false
+		}
+		if *args.templateRaw == "" {
+			_, _ = fmt.Fprintln(os.Stderr, "-format template needs a -template.")
+			valid = false
+		}
+		args.template = tmpl
+	default:
+		_, _ = fmt.Fprintln(os.Stderr, "-format needs to be one of raw, json, text, csv or template.")
+		valid = false
+	}
+	switch *args.colorRaw {
+	case "always":
+		args.color = true
+	case "never":
+		args.color = false
+	case "auto":
+		args.color = stdoutIsTerminal() && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+	default:
+		_, _ = fmt.Fprintln(os.Stderr, "-color needs to be one of always, never or auto.")
+		valid = false
+	}
+	if *args.format != "raw" && *args.format != "text" {
+		// escape codes would break structured output
+		args.color = false
+	}
+	if *args.countBy != "" || *args.countOnly {
+		if *args.countBy != "" && *args.countOnly {
+			_, _ = fmt.Fprintln(os.Stderr, "Passing both -count and -count-by doesn't make sense.")
+			valid = false
+		}
+		if *args.contextBefore != 0 || *args.contextAfter != 0 || *args.contextBoth != 0 || *args.showPattern {
+			_, _ = fmt.Fprintln(os.Stderr, "-count and -count-by don't print messages, -A, -B, -C and -show-pattern can't be used.")
+			valid = false
+		}
+	}
+	if *args.contextBefore < 0 || *args.contextAfter < 0 || *args.contextBoth < 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "-A, -B and -C need to be positive numbers.")
+		valid = false
+	}
 	// show missing arguments and that's it
 	if !valid {
 		return
 	}
 
-	startTime, err := parseTime(*args.start)
+	location, err := justgrep.ParseTimeZone(*args.timeZone)
+	args.location = location
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "-tz: %s\n", err)
+		return false
+	}
+	if *args.countBy != "" {
+		// hours and days are counted in -tz
+		group, byKey, err := justgrep.ParseGroupBy(*args.countBy, args.location)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-count-by: %s\n", err)
+			valid = false
+		} else {
+			args.counter = justgrep.NewCounter(group, byKey)
+		}
+	}
+	startTime, err := parseTime(*args.start, args.location)
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "-start: Invalid time: %s: %s\n", *args.start, err)
 		valid = false
 	}
 	args.startTime = startTime
+	if *args.contextBoth != 0 {
+		if *args.contextBefore == 0 {
+			*args.contextBefore = *args.contextBoth
+		}
+		if *args.contextAfter == 0 {
+			*args.contextAfter = *args.contextBoth
+		}
+	}
+	for _, expr := range args.tagsRaw {
+		tag, err := justgrep.ParseTagPredicate(expr)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-tag: %s\n", err)
+			valid = false
+		}
+		args.tags = append(args.tags, tag)
+	}
 	if *args.end == "" {
 		args.endTime = time.Now().UTC()
 	} else {
-		endTime, err := parseTime(*args.end)
+		endTime, err := parseTime(*args.end, args.location)
 		if err != nil {
 			_, _ = fmt.Fprintf(os.Stderr, "-end: Invalid time: %s: %s\n", *args.end, err)
 			valid = false
@@ -134,10 +355,21 @@ const progressNextChannel = "nextChannel"
 const progressNextStep = "nextStep"
 const errorWhileFetching = "fetchError"
 const summaryFinished = "summaryFinished"
+const fetchRetry = "fetchRetry"
+const fetchFailed = "fetchFailed"
 
 var gitCommit = "[unavailable]"
 var httpClient = http.Client{}
 
+// stderrLock keeps JSON progress updates of concurrently searched channels from mixing
+var stderrLock sync.Mutex
+
+func reportJson(v interface{}) {
+	stderrLock.Lock()
+	defer stderrLock.Unlock()
+	_ = json.NewEncoder(os.Stderr).Encode(v)
+}
+
 const EnvDefaultInstances = "JUSTGREP_DEFAULT_INSTANCES"
 
 func cleanUrl(url string) (string) {
@@ -148,6 +380,10 @@ func cleanUrl(url string) (string) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "names" {
+		namesMain(os.Args[2:])
+		return
+	}
 	args := &arguments{}
 	args.user = flag.String("user", "", "Target user")
 	args.notUser = flag.String("notuser", "", "Negative match on username")
@@ -164,17 +400,128 @@ func main() {
 		"Return only messages with COMMANDs in the comma separated list.",
 	)
 
+	args.patternsFile = flag.String(
+		"patterns-file",
+		"",
+		"Only return messages matching any of the patterns in this file, one per line",
+	)
+	args.patternsMode = flag.String(
+		"patterns-mode",
+		"fixed",
+		"How to treat lines of -patterns-file: fixed (plain strings) or regex (one regex per line)",
+	)
+	args.patternsIgnoreCase = flag.Bool("patterns-ignore-case", false, "Match -patterns-file case-insensitively")
+	args.showPattern = flag.Bool(
+		"show-pattern",
+		false,
+		"Prefix every result with the -patterns-file pattern that matched it and a tab",
+	)
+	flag.Var(
+		&args.tagsRaw,
+		"tag",
+		"Only return messages with matching IRCv3 tags: key, !key, key=value, key!=value, key~regex, key>=N. "+
+			"Can be repeated, all of them need to match.",
+	)
+
 	args.channel = flag.String("channel", "", "Target channel")
 	args.messageRegex = flag.String("regex", "", "Message Regex")
+	args.query = flag.String(
+		"q",
+		"",
+		"Boolean query, e.g. '(user:a OR user:b) AND NOT msg:/^!cmd/ AND type:PRIVMSG'. See man page for syntax.",
+	)
 	args.start = flag.String("start", "", "Start time")
 	args.end = flag.String("end", "", "End time")
+	args.timeZone = flag.String(
+		"tz",
+		"UTC",
+		"Time zone of -start and -end without an offset, -format text and -count-by hour|day, an IANA name like "+
+			"Europe/Warsaw or local",
+	)
+	args.timeFormat = flag.String(
+		"time-format",
+		"2006-01-02 15:04:05",
+		"Timestamps of -format text: Go time layout or rfc3339, unix, unixms or relative (to -start)",
+	)
+	args.noTime = flag.Bool("no-time", false, "Don't show timestamps with -format text")
 	args.url = flag.String("url", "", "Justlog instance URL")
+	args.dir = flag.String(
+		"dir",
+		"",
+		"Search a local justlog logs directory instead of an instance, -channel and -user need to be ids",
+	)
+	args.federated = flag.Bool(
+		"federated",
+		false,
+		"Search every instance from "+EnvDefaultInstances+" that has the channel and merge the results",
+	)
+	args.showInstances = flag.Bool(
+		"show-instances",
+		false,
+		"Prefix every result with the -federated instances it was found on and a tab",
+	)
+	args.format = flag.String(
+		"format",
+		"raw",
+		"How to print results: raw (IRC lines), json (like irc2json), text (like irc2text), csv or template",
+	)
+	args.templateRaw = flag.String(
+		"template",
+		"",
+		"Go text/template used for every result with -format template, e.g. '{{.User}}: {{index .Args 1}}'",
+	)
+	args.colorRaw = flag.String(
+		"color",
+		"auto",
+		"Highlight matches and color user names with -format raw or text: always, never or auto (only on a terminal)",
+	)
 	args.maxResults = flag.Int("max", 0, "How many results do you want? 0 for unlimited")
+	args.countBy = flag.String(
+		"count-by",
+		"",
+		"Print the number of matches per user, channel, hour, day, type or tag:<name> instead of the messages",
+	)
+	args.countOnly = flag.Bool("count", false, "Only print the number of matching messages")
+	args.contextAfter = flag.Int("A", 0, "Print N messages sent after every match")
+	args.contextBefore = flag.Int("B", 0, "Print N messages sent before every match")
+	args.contextBoth = flag.Int("C", 0, "Print N messages sent before and after every match, same as -A N -B N")
+
+	args.jobs = flag.Int("j", 1, "How many log files to download at once")
+	args.channelJobs = flag.Int("channel-jobs", 1, "How many channels to search at once with -r or multiple -channel")
+	args.channelOutput = flag.String(
+		"channel-output",
+		"grouped",
+		"How to print results of channels searched at once: grouped (all results of a channel together, in "+
+			"channel order, later channels are kept in memory until the earlier ones are done) or interleaved (as "+
+			"they come, prefixed with the channel)",
+	)
 
 	args.verbose = flag.Bool("v", false, "Show human-readable progress information")
 	args.progressJson = flag.Bool("progress-json", false, "Send JSON progress updates to stderr, not allowed with -v.")
 	args.recursive = flag.Bool("r", false, "Run search on all channels.")
 
+	args.cacheDir = flag.String(
+		"cache-dir",
+		"",
+		"Where to keep downloaded log files, defaults to justgrep in your user cache directory",
+	)
+	args.cacheSize = flag.Int("cache-size", 2048, "Maximum size of the cache in megabytes, 0 for unlimited")
+	args.noCache = flag.Bool("no-cache", false, "Don't read or write cached log files")
+
+	args.retries = flag.Int("retries", 3, "How many times to retry failed or interrupted downloads of a log file")
+	args.retryDelay = flag.Duration("retry-delay", time.Second, "How long to wait before the first retry")
+	args.retryMaxDelay = flag.Duration(
+		"retry-max-delay",
+		30*time.Second,
+		"Longest wait between retries, delays double after every attempt",
+	)
+	args.onError = flag.String(
+		"on-error",
+		"skip",
+		"What to do when a log file can't be downloaded: stop (searching the channel), skip (to the next file) or "+
+			"retry (the whole file, while it has retries left, then skip)",
+	)
+
 	args.noEnv = flag.Bool("no-env", false, "Disables reading environment variables like JUSTGREP_DEFAULT_INSTANCES")
 	flag.Usage = func() {
 		fmt.Fprintf(
@@ -191,6 +538,10 @@ func main() {
 	if !flagsAreValid {
 		os.Exit(1)
 	}
+	if !*args.noCache {
+		setupCache(args)
+	}
+	setupRetries(args)
 
 	var defaultInstancesEnv string
 	defaultInstances := []string{*args.url}
@@ -204,7 +555,7 @@ func main() {
 
 	if len(defaultInstances) == 1 && defaultInstances[0] == "" {
 		defaultInstances = []string{"http://localhost:8025"}
-		if *args.verbose {
+		if *args.verbose && *args.dir == "" {
 			fmt.Fprintf(
 				os.Stderr,
 				"Assuming you wanted to use %s as the justlog instance. Use -url or set the %q env variable.\n",
@@ -214,7 +565,7 @@ func main() {
 		}
 	}
 
-	if *args.recursive && len(defaultInstances) > 1 {
+	if *args.recursive && len(defaultInstances) > 1 && *args.dir == "" && !*args.federated {
 		instancesSafe := []string{}
 		for _, instance := range defaultInstances {
 			itext := ""
@@ -237,8 +588,29 @@ func main() {
 	}
 
 	justlogUrl := ""
+	// instances having each channel, in the order they were given in, only used with -federated
+	var channelInstances map[string][]string
+	var federatedChannels []string
 
-	if *args.recursive {
+	if *args.dir != "" {
+		// offline search, no instance needed
+	} else if *args.federated {
+		channelInstances, federatedChannels = findChannelInstances(args, defaultInstances)
+		if len(federatedChannels) == 0 {
+			fmt.Fprintf(os.Stderr, "No justlog instance has the channel %q\n", *args.channel)
+			os.Exit(1)
+		}
+		if *args.verbose {
+			for _, channel := range federatedChannels {
+				fmt.Fprintf(
+					os.Stderr,
+					"Searching #%s on: %s\n",
+					channel,
+					strings.Join(redactUrls(channelInstances[channel]), ", "),
+				)
+			}
+		}
+	} else if *args.recursive {
 		justlogUrl = cleanUrl(defaultInstances[0])
 	} else {
 	instanceLoop:
@@ -250,12 +622,14 @@ func main() {
 				fmt.Fprintf(os.Stderr, "Fetching channels from %q failed: %s\n", instance, err.Error())
 				continue instanceLoop
 			}
-			for _, chn := range chns {
-				if *args.channel == chn {
-					justlogUrl = instance
-					break instanceLoop
+			// with a comma separated -channel every channel has to be on the same instance
+			for _, chn := range strings.Split(*args.channel, ",") {
+				if !hasChannel(chns, chn) {
+					continue instanceLoop
 				}
 			}
+			justlogUrl = instance
+			break instanceLoop
 		}
 		if justlogUrl == "" {
 			fmt.Fprintf(os.Stderr, "No justlog instance has the channel %q\n", *args.channel)
@@ -292,6 +666,22 @@ func main() {
 			return
 		}
 	}
+	var query *justgrep.Query
+	if *args.query != "" {
+		query, err = justgrep.ParseQuery(*args.query)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error while parsing your query: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	var patterns *justgrep.PatternSet
+	if *args.patternsFile != "" {
+		patterns, err = loadPatterns(args)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error while loading your patterns file: %s\n", err)
+			os.Exit(1)
+		}
+	}
 	args.messageTypes = strings.Split(*args.messageTypesRaw, ",")
 	filter := justgrep.Filter{
 		StartDate: args.startTime,
@@ -303,6 +693,9 @@ func main() {
 		HasMessageRegex: true,
 		MessageRegex:    messageExpr,
 
+		HasPatterns: patterns != nil,
+		Patterns:    patterns,
+
 		UserMatchType: matchMode,
 
 		UserName:         strings.ToLower(*args.user),
@@ -311,13 +704,31 @@ func main() {
 		NegativeUserRegex: negativeRegex,
 		UserRegex:         userRegex,
 
+		Tags: args.tags,
+
+		HasQuery: query != nil,
+		Query:    query,
+
 		Count: *args.maxResults,
+
+		ContextBefore: *args.contextBefore,
+		ContextAfter:  *args.contextAfter,
 	}
 	var channelsToSearch []string
-	if !*args.recursive {
+	// channels of the instance when using -r
+	var instanceChannels justgrep.ChannelList
+	if *args.federated {
+		channelsToSearch = federatedChannels
+	} else if !*args.recursive {
 		channelsToSearch = strings.Split(*args.channel, ",")
+	} else if *args.dir != "" {
+		channelsToSearch, err = justgrep.GetChannelsFromDir(*args.dir)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error while listing channels in %s: %s\n", *args.dir, err)
+			os.Exit(1)
+		}
 	} else {
-		channelsToSearch, err = justgrep.GetChannelsFromJustLog(context.Background(), &httpClient, justlogUrl)
+		instanceChannels, err = justgrep.GetChannelsFromJustLog(context.Background(), &httpClient, justlogUrl)
 		if err != nil {
 			_, err := fmt.Fprintf(os.Stderr, "Error while fetching channels from justlog: %s", err)
 			if err != nil {
@@ -325,83 +736,691 @@ func main() {
 			}
 			os.Exit(1)
 		}
+		for _, chn := range instanceChannels {
+			channelsToSearch = append(channelsToSearch, chn.Name)
+		}
 	}
+	// local directories only have user logs by id, other users are searched for in channel logs
+	useUserLogs := *args.user != "" && !(*args.userIsRegex) && (*args.dir == "" || (*args.user)[0] == '#')
 	// fix name changes and USERNOTICEs not showing up when using per-user log endpoint
-	if *args.user != "" && !(*args.userIsRegex) {
+	if useUserLogs {
 		filter.UserMatchType = justgrep.DontMatch
 	}
+	// everything a user said on the instance is searched in one go, using the per-user logs of all channels
+	userHistory := *args.recursive && useUserLogs && *args.dir == "" && !*args.federated
+	if userHistory {
+		channelsToSearch = []string{"*"}
+	}
 
-	progress := &justgrep.ProgressState{
-		TotalResults: make([]int, justgrep.ResultCount),
-		BeginTime:    time.Now(),
+	shared := &sharedProgress{
+		state: &justgrep.ProgressState{
+			TotalResults: make([]int, justgrep.ResultCount),
+			BeginTime:    time.Now(),
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer := &resultWriter{
+		args:          args,
+		filter:        filter,
+		cancel:        cancel,
+		prefixChannel: *args.channelOutput == "interleaved" && len(channelsToSearch) > 1,
+		multiChannel:  len(channelsToSearch) > 1 || userHistory,
+	}
+	if *args.format == "csv" && args.counter == nil && !*args.countOnly {
+		writer.printCsvHeader()
 	}
+	slots := make(chan struct{}, *args.channelJobs)
+	wg := sync.WaitGroup{}
 	for currentIndex, channel := range channelsToSearch {
-		if *args.verbose {
-			_, _ = fmt.Fprintf(os.Stderr, "Now scanning #%s %d/%d\n", channel, currentIndex+1, len(channelsToSearch))
-		}
-		if *args.progressJson {
-			_ = json.NewEncoder(os.Stderr).Encode(
-				progressUpdate{
-					Type:              progressNextChannel,
-					Found:             progress.TotalResults[justgrep.ResultOk],
-					Channel:           channel,
-					CurrentChannelNum: currentIndex,
-					CountChannels:     len(channelsToSearch),
-					Progress:          *progress,
-				},
-			)
+		slots <- struct{}{}
+		if ctx.Err() != nil || writer.limitReached() {
+			break
 		}
-		var api justgrep.JustlogAPI
-		if *args.user != "" && !(*args.userIsRegex) {
-			if (*args.user)[0] == '#' {
-				api = &justgrep.UserJustlogAPI{User: (*args.user)[1:], Channel: channel, URL: justlogUrl, IsId: true}
+		// channels are registered in order, grouped output follows it
+		output := writer.forChannel(
+			strings.TrimPrefix(channel, "#"),
+			*args.channelJobs > 1 && *args.channelOutput == "grouped",
+		)
+		wg.Add(1)
+		go func(currentIndex int, channel string, output *channelWriter) {
+			defer wg.Done()
+			defer func() {
+				<-slots
+			}()
+			if *args.verbose {
+				_, _ = fmt.Fprintf(
+					os.Stderr,
+					"Now scanning #%s %d/%d\n",
+					strings.TrimPrefix(channel, "#"),
+					currentIndex+1,
+					len(channelsToSearch),
+				)
+			}
+			if *args.progressJson {
+				total := shared.snapshot()
+				reportJson(
+					progressUpdate{
+						Type:              progressNextChannel,
+						Found:             total.TotalResults[justgrep.ResultOk],
+						Channel:           channel,
+						CurrentChannelNum: currentIndex,
+						CountChannels:     len(channelsToSearch),
+						Progress:          total,
+						ChannelProgress: justgrep.ProgressState{
+							TotalResults: make([]int, justgrep.ResultCount),
+							BeginTime:    time.Now(),
+						},
+					},
+				)
+			}
+			var api justgrep.JustlogAPI
+			if userHistory {
+				user := *args.user
+				history := justgrep.NewUserHistoryAPI(justlogUrl, instanceChannels, strings.TrimPrefix(user, "#"), user[0] == '#')
+				history.Jobs = *args.channelJobs
+				api = history
+			} else if *args.federated {
+				federated := &justgrep.FederatedJustlogAPI{}
+				for _, instance := range channelInstances[channel] {
+					federated.APIs = append(federated.APIs, makeAPI(args, channel, instance, useUserLogs))
+				}
+				federated.Instances = redactUrls(channelInstances[channel])
+				api = federated
 			} else {
-				api = &justgrep.UserJustlogAPI{User: *args.user, Channel: channel, URL: justlogUrl}
+				api = makeAPI(args, channel, justlogUrl, useUserLogs)
 			}
-		} else {
-			api = &justgrep.ChannelJustlogAPI{Channel: channel, URL: justlogUrl}
-		}
-		searchLogs(args, api, filter, progress)
+			searchLogs(ctx, args, api, filter, shared, output)
+			output.finish()
+		}(currentIndex, channel, output)
+	}
+	wg.Wait()
+
+	progress := shared.state
+	if writer.maxReached {
+		// matches over the limit found by channels searched at the same time weren't printed
+		progress.TotalResults[justgrep.ResultOk] = writer.found
+		progress.TotalResults[justgrep.ResultMaxCountReached] = 1
+	}
+	if *args.countOnly {
+		fmt.Println(writer.found)
+	}
+	if args.counter != nil {
+		printCounts(args)
 	}
 	if *args.verbose {
 		_, _ = fmt.Fprintf(os.Stderr, "Summary:\n")
+		if len(shared.failed) != 0 {
+			_, _ = fmt.Fprintf(os.Stderr, "Results are incomplete, failed to search %d log files:\n", len(shared.failed))
+			for _, failed := range shared.failed {
+				if failed.Date == "" {
+					_, _ = fmt.Fprintf(os.Stderr, " - #%s: %s\n", failed.Channel, failed.Error)
+					continue
+				}
+				_, _ = fmt.Fprintf(os.Stderr, " - #%s at %s: %s\n", failed.Channel, failed.Date, failed.Error)
+			}
+		}
 		if progress.CountLines == 0 {
 			// no lines fetched at all
 			fmt.Fprintf(os.Stderr, "Nothing here. No lines were processed.\n")
-			return
-		}
-		for result, count := range progress.TotalResults {
-			_, _ = fmt.Fprintf(os.Stderr, " - %s => %d\n", justgrep.FilterResult(result), count)
+		} else {
+			printSummary(progress)
 		}
-		const Mega = 1000.0 * 1000.0
-		const Milli = 0.001
-		timeTaken := time.Now().Sub(progress.BeginTime)
-		_, _ = fmt.Fprintf(
-			os.Stderr,
-			"Processed %.2f MB (%.2f MB/s)\n"+
-				"Lines processed: %d\n"+
-				"Average line length: %d\n"+
-				"Time taken: %s\n",
-			float64(progress.CountBytes)/Mega,
-			float64(progress.CountBytes)/float64(timeTaken.Milliseconds())/Milli/Mega,
-			progress.CountLines,
-			progress.CountBytes/progress.CountLines,
-			timeTaken.Truncate(time.Second),
-		)
 	}
 	if *args.progressJson {
 		res := make(map[string]int)
 		for result, count := range progress.TotalResults {
 			res[justgrep.FilterResult(result).String()] = count
 		}
+		failed := shared.failed
+		if failed == nil {
+			failed = []failedLog{}
+		}
 		_ = json.NewEncoder(os.Stderr).Encode(
 			summaryReport{
 				Type:     summaryFinished,
 				Results:  res,
 				Progress: *progress,
+				Failed:   failed,
 			},
 		)
 	}
+	if len(shared.failed) != 0 {
+		os.Exit(2)
+	}
+}
+
+func printSummary(progress *justgrep.ProgressState) {
+	for result, count := range progress.TotalResults {
+		_, _ = fmt.Fprintf(os.Stderr, " - %s => %d\n", justgrep.FilterResult(result), count)
+	}
+	const Mega = 1000.0 * 1000.0
+	const Milli = 0.001
+	timeTaken := time.Now().Sub(progress.BeginTime)
+	_, _ = fmt.Fprintf(
+		os.Stderr,
+		"Processed %.2f MB (%.2f MB/s)\n"+
+			"Lines processed: %d\n"+
+			"Average line length: %d\n"+
+			"Time taken: %s\n",
+		float64(progress.CountBytes)/Mega,
+		float64(progress.CountBytes)/float64(timeTaken.Milliseconds())/Milli/Mega,
+		progress.CountLines,
+		progress.CountBytes/progress.CountLines,
+		timeTaken.Truncate(time.Second),
+	)
+}
+
+// hasChannel checks if channel, a name or an id prefixed with #, is in chns
+func hasChannel(chns justgrep.ChannelList, channel string) bool {
+	var ok bool
+	if strings.HasPrefix(channel, "#") {
+		_, ok = chns.ByID(channel[1:])
+	} else {
+		_, ok = chns.ByName(channel)
+	}
+	return ok
+}
+
+func makeAPI(args *arguments, channel string, justlogUrl string, useUserLogs bool) justgrep.JustlogAPI {
+	channelIsId := strings.HasPrefix(channel, "#")
+	channel = strings.TrimPrefix(channel, "#")
+	if *args.dir != "" {
+		if useUserLogs {
+			return &justgrep.DirJustlogAPI{Dir: *args.dir, ChannelID: channel, UserID: (*args.user)[1:]}
+		}
+		return &justgrep.DirJustlogAPI{Dir: *args.dir, ChannelID: channel}
+	}
+	if useUserLogs {
+		if (*args.user)[0] == '#' {
+			return &justgrep.UserJustlogAPI{
+				User:        (*args.user)[1:],
+				Channel:     channel,
+				URL:         justlogUrl,
+				IsId:        true,
+				ChannelIsId: channelIsId,
+			}
+		}
+		return &justgrep.UserJustlogAPI{User: *args.user, Channel: channel, URL: justlogUrl, ChannelIsId: channelIsId}
+	}
+	return &justgrep.ChannelJustlogAPI{Channel: channel, URL: justlogUrl, IsId: channelIsId}
+}
+
+// findChannelInstances returns which instances have the channels to search and the channels found on any of them.
+// With -r that's every channel of every instance.
+func findChannelInstances(args *arguments, instances []string) (map[string][]string, []string) {
+	wanted := map[string]bool{}
+	if !*args.recursive {
+		for _, channel := range strings.Split(*args.channel, ",") {
+			wanted[channel] = true
+		}
+	}
+	channelInstances := map[string][]string{}
+	var channels []string
+	for _, instance := range instances {
+		instance = cleanUrl(instance)
+		chns, err := justgrep.GetChannelsFromJustLog(context.Background(), &httpClient, instance)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Fetching channels from %q failed: %s\n", redactUrls([]string{instance})[0], err)
+			continue
+		}
+		for _, chn := range chns {
+			key := chn.Name
+			if !*args.recursive {
+				if wanted["#"+chn.UserID] {
+					key = "#" + chn.UserID
+				} else if !wanted[chn.Name] {
+					continue
+				}
+			}
+			if _, ok := channelInstances[key]; !ok {
+				channels = append(channels, key)
+			}
+			channelInstances[key] = append(channelInstances[key], instance)
+		}
+	}
+	if !*args.recursive {
+		// keep the order of -channel
+		channels = channels[:0]
+		for _, channel := range strings.Split(*args.channel, ",") {
+			if _, ok := channelInstances[channel]; ok {
+				channels = append(channels, channel)
+			} else {
+				fmt.Fprintf(os.Stderr, "No justlog instance has the channel %q\n", channel)
+			}
+		}
+	}
+	return channelInstances, channels
+}
+
+// redactUrls hides passwords in instance URLs so they can be shown
+func redactUrls(urls []string) []string {
+	out := make([]string, len(urls))
+	for i, instance := range urls {
+		out[i] = justgrep.RedactURL(instance)
+	}
+	return out
+}
+
+func setupRetries(args *arguments) {
+	policy := &justgrep.FetchRetryPolicy
+	policy.MaxRetries = *args.retries
+	policy.InitialDelay = *args.retryDelay
+	policy.MaxDelay = *args.retryMaxDelay
+	if *args.progressJson {
+		policy.OnRetry = func(url string, attempt int, delay time.Duration, err error) {
+			reportJson(
+				retryReport{
+					Type:    fetchRetry,
+					URL:     url,
+					Attempt: attempt,
+					Delay:   delay.Seconds(),
+					Error:   err.Error(),
+				},
+			)
+		}
+		policy.OnFailure = func(url string, err error) {
+			reportJson(
+				retryReport{
+					Type:  fetchFailed,
+					URL:   url,
+					Error: err.Error(),
+				},
+			)
+		}
+	} else if *args.verbose {
+		policy.OnRetry = func(url string, attempt int, delay time.Duration, err error) {
+			stderrLock.Lock()
+			defer stderrLock.Unlock()
+			_, _ = fmt.Fprintf(
+				os.Stderr,
+				"Error while fetching from %s: %s, retrying in %s (%d/%d)\n",
+				url,
+				err,
+				delay.Round(time.Millisecond),
+				attempt,
+				policy.MaxRetries,
+			)
+		}
+	}
+}
+
+func setupCache(args *arguments) {
+	dir := *args.cacheDir
+	if dir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			if *args.verbose {
+				_, _ = fmt.Fprintf(os.Stderr, "Not caching log files, no cache directory: %s\n", err)
+			}
+			return
+		}
+		dir = filepath.Join(userCache, "justgrep")
+	}
+	cache, err := justgrep.NewLogCache(dir, int64(*args.cacheSize)*1000*1000)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Not caching log files: %s\n", err)
+		return
+	}
+	justgrep.LogFileCache = cache
+}
+
+func loadPatterns(args *arguments) (*justgrep.PatternSet, error) {
+	file, err := os.Open(*args.patternsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	lines, err := justgrep.ReadPatterns(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s contains no patterns", *args.patternsFile)
+	}
+	if *args.patternsMode == "regex" {
+		return justgrep.NewRegexPatternSet(lines, *args.patternsIgnoreCase)
+	}
+	return justgrep.NewFixedPatternSet(lines, *args.patternsIgnoreCase), nil
+}
+
+// sharedProgress sums up the progress of all channels searched at once
+type sharedProgress struct {
+	lock  sync.Mutex
+	state *justgrep.ProgressState
+
+	failed []failedLog
+}
+
+func (p *sharedProgress) fail(failed failedLog) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.failed = append(p.failed, failed)
+}
+
+func (p *sharedProgress) add(results []int, countLines int, countBytes int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for result, count := range results {
+		p.state.TotalResults[result] += count
+	}
+	p.state.CountLines += countLines
+	p.state.CountBytes += countBytes
+}
+
+func (p *sharedProgress) snapshot() justgrep.ProgressState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	state := *p.state
+	state.TotalResults = append([]int(nil), p.state.TotalResults...)
+	return state
+}
+
+// resultWriter prints matching and context lines of all channels, enforcing -max across all of them
+type resultWriter struct {
+	lock sync.Mutex
+
+	args          *arguments
+	filter        justgrep.Filter
+	cancel        context.CancelFunc
+	prefixChannel bool
+	// multiChannel adds the channel to -format json, csv and template results
+	multiChannel bool
+
+	found        int
+	maxReached   bool
+	printedGroup bool
+
+	// grouped holds the channels of grouped output in order, the one at streaming is printed right away
+	grouped   []*channelWriter
+	streaming int
+}
+
+func (w *resultWriter) limitReached() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.filter.Count != 0 && w.found >= w.filter.Count
+}
+
+// channelWriter writes results of a single channel. For grouped output, they're held back while an earlier channel is
+// still being searched.
+type channelWriter struct {
+	writer  *resultWriter
+	channel string
+
+	// index is the position in resultWriter.grouped, buffer is only set for grouped output
+	index        int
+	buffer       *bytes.Buffer
+	printedGroup bool
+	finished     bool
+}
+
+// forChannel makes the writer of the next channel, they have to be made in the order their results should be printed
+func (w *resultWriter) forChannel(channel string, buffered bool) *channelWriter {
+	out := &channelWriter{writer: w, channel: channel}
+	if buffered {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		out.buffer = &bytes.Buffer{}
+		out.index = len(w.grouped)
+		w.grouped = append(w.grouped, out)
+	}
+	return out
+}
+
+// print handles a single matching or context line
+func (o *channelWriter) print(msg *justgrep.Message, isContext bool, groupStart bool) {
+	w := o.writer
+	args := w.args
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !isContext {
+		if w.filter.Count != 0 && w.found >= w.filter.Count {
+			w.maxReached = true
+			w.cancel()
+			return
+		}
+		w.found++
+		if args.counter != nil {
+			args.counter.Add(msg)
+		}
+	}
+	if args.counter != nil || *args.countOnly {
+		return
+	}
+
+	// structured formats mark context lines instead
+	separate := *args.format != "json" && *args.format != "csv"
+	var out io.Writer = os.Stdout
+	if o.buffer != nil && o.index != w.streaming {
+		out = o.buffer
+		if separate && groupStart && o.printedGroup {
+			_, _ = fmt.Fprintln(out, "--")
+		}
+		o.printedGroup = true
+	} else if o.buffer != nil {
+		// the earliest channel still being searched, separated from the previous one like in flush
+		if separate && groupStart && o.printedGroup {
+			_, _ = fmt.Fprintln(out, "--")
+		} else if separate && !o.printedGroup && w.printedGroup && w.hasContext() {
+			_, _ = fmt.Fprintln(out, "--")
+		}
+		o.printedGroup = true
+		w.printedGroup = true
+	} else {
+		if separate && groupStart && w.printedGroup {
+			_, _ = fmt.Fprintln(out, "--")
+		}
+		w.printedGroup = true
+	}
+	w.format(out, o.channel, msg, isContext)
+}
+
+// outputMessage is a result as seen by -format json and template
+type outputMessage struct {
+	*justgrep.Message
+
+	// Channel is only set when searching more than one channel
+	Channel string `json:"channel,omitempty"`
+	// Instances is only set with -federated
+	Instances []string `json:"instances,omitempty"`
+	// Pattern is only set with -show-pattern
+	Pattern   string `json:"pattern,omitempty"`
+	IsContext bool   `json:"is_context,omitempty"`
+}
+
+func (w *resultWriter) newOutputMessage(channel string, msg *justgrep.Message, isContext bool) outputMessage {
+	out := outputMessage{Message: msg, IsContext: isContext}
+	if w.multiChannel {
+		out.Channel = channel
+		// -r -user searches all channels at once
+		if len(msg.Args) != 0 && strings.HasPrefix(msg.Args[0], "#") {
+			out.Channel = msg.Args[0][1:]
+		}
+	}
+	out.Instances = msg.Instances
+	if *w.args.showPattern {
+		out.Pattern, _ = w.filter.Patterns.MatchMessage(msg)
+	}
+	return out
+}
+
+// format writes a single result in the -format chosen
+func (w *resultWriter) format(out io.Writer, channel string, msg *justgrep.Message, isContext bool) {
+	args := w.args
+	switch *args.format {
+	case "json":
+		_ = json.NewEncoder(out).Encode(w.newOutputMessage(channel, msg, isContext))
+		return
+	case "csv":
+		result := w.newOutputMessage(channel, msg, isContext)
+		text := ""
+		if len(msg.Args) > 1 {
+			text = msg.Args[len(msg.Args)-1]
+		}
+		msgChannel := channel
+		if len(msg.Args) != 0 && strings.HasPrefix(msg.Args[0], "#") {
+			msgChannel = msg.Args[0][1:]
+		}
+		record := []string{
+			msg.Timestamp.UTC().Format(time.RFC3339Nano),
+			msgChannel,
+			msg.User,
+			msg.Action,
+			text,
+			msg.Tags["id"],
+		}
+		if *args.federated {
+			record = append(record, strings.Join(result.Instances, ","))
+		}
+		if *args.showPattern {
+			record = append(record, result.Pattern)
+		}
+		if w.filter.ContextBefore != 0 || w.filter.ContextAfter != 0 {
+			record = append(record, strconv.FormatBool(isContext))
+		}
+		writer := csv.NewWriter(out)
+		_ = writer.Write(record)
+		writer.Flush()
+		return
+	case "template":
+		err := args.template.Execute(out, w.newOutputMessage(channel, msg, isContext))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error while executing your template: %s\n", err)
+		}
+		_, _ = fmt.Fprintln(out)
+		return
+	}
+
+	dim := func(text string) string {
+		if args.color {
+			return justgrep.Dim(text)
+		}
+		return text
+	}
+	if w.prefixChannel {
+		_, _ = fmt.Fprintf(out, "%s\t", dim("#"+channel))
+	}
+	if *args.showInstances {
+		_, _ = fmt.Fprintf(out, "%s\t", dim(strings.Join(msg.Instances, ",")))
+	}
+	if *args.showPattern {
+		pattern, _ := w.filter.Patterns.MatchMessage(msg)
+		_, _ = fmt.Fprintf(out, "%s\t", pattern)
+	}
+	var highlights [][]int
+	if args.color && !isContext {
+		highlights = w.filter.MatchPositions(msg)
+	}
+	if *args.format == "text" {
+		opts := justgrep.RenderOptions{
+			Color:      args.color,
+			Highlights: highlights,
+			Location:   args.location,
+			TimeFormat: *args.timeFormat,
+			RelativeTo: args.startTime,
+			NoTime:     *args.noTime,
+		}
+		if text, ok := justgrep.RenderTextWith(msg, opts); ok {
+			_, _ = fmt.Fprintln(out, text)
+			return
+		}
+	}
+	_, _ = fmt.Fprintln(out, highlightRaw(msg, highlights))
+}
+
+// highlightRaw marks highlights in the message text at the end of the raw IRC line
+func highlightRaw(msg *justgrep.Message, highlights [][]int) string {
+	if len(highlights) == 0 || len(msg.Args) == 0 {
+		return msg.Raw
+	}
+	text := msg.Args[len(msg.Args)-1]
+	if !strings.HasSuffix(msg.Raw, text) {
+		return msg.Raw
+	}
+	offset := len(msg.Raw) - len(text)
+	return msg.Raw[:offset] + justgrep.Highlight(text, highlights)
+}
+
+func stdoutIsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+func (w *resultWriter) printCsvHeader() {
+	header := []string{"timestamp", "channel", "user", "action", "message", "id"}
+	if *w.args.federated {
+		header = append(header, "instances")
+	}
+	if *w.args.showPattern {
+		header = append(header, "pattern")
+	}
+	if w.filter.ContextBefore != 0 || w.filter.ContextAfter != 0 {
+		header = append(header, "context")
+	}
+	writer := csv.NewWriter(os.Stdout)
+	_ = writer.Write(header)
+	writer.Flush()
+}
+
+func (w *resultWriter) hasContext() bool {
+	return w.filter.ContextBefore != 0 || w.filter.ContextAfter != 0
+}
+
+// finish is called once the channel was searched. With grouped output, the results held back for the next channels
+// are printed up to the first one still being searched, which prints right away from then on.
+func (o *channelWriter) finish() {
+	if o.buffer == nil {
+		return
+	}
+	w := o.writer
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	o.finished = true
+	for w.streaming < len(w.grouped) && w.grouped[w.streaming].finished {
+		w.streaming++
+		if w.streaming < len(w.grouped) {
+			w.grouped[w.streaming].flush()
+		}
+	}
+}
+
+// flush prints results held back for grouped output, w.lock has to be held
+func (o *channelWriter) flush() {
+	if o.buffer.Len() == 0 {
+		return
+	}
+	w := o.writer
+	structured := *w.args.format == "json" || *w.args.format == "csv"
+	if w.printedGroup && !structured && w.hasContext() {
+		fmt.Println("--")
+	}
+	w.printedGroup = true
+	_, _ = o.buffer.WriteTo(os.Stdout)
+}
+
+func printCounts(args *arguments) {
+	if *args.progressJson {
+		_ = json.NewEncoder(os.Stdout).Encode(args.counter.Counts)
+		return
+	}
+	entries := args.counter.Sorted()
+	width := 1
+	for _, entry := range entries {
+		if w := len(strconv.Itoa(entry.Count)); w > width {
+			width = w
+		}
+	}
+	for _, entry := range entries {
+		key := entry.Key
+		if key == "" {
+			key = "(none)"
+		}
+		fmt.Printf("%*d %s\n", width, entry.Count, key)
+	}
 }
 
 const progressSize = 50
@@ -421,52 +1440,59 @@ func makeProgressBar(totalSteps float64, stepsLeft float64) string {
 }
 
 func searchLogs(
+	parentCtx context.Context,
 	args *arguments,
 	api justgrep.JustlogAPI,
 	filter justgrep.Filter,
-	progress *justgrep.ProgressState,
+	shared *sharedProgress,
+	output *channelWriter,
 ) {
 	nextDate := args.endTime
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
-	var channel string
-	switch api.(type) {
-	default:
-		channel = fmt.Sprintf("[unknown] (%t)", api)
-	case *justgrep.UserJustlogAPI:
-		channel = api.(*justgrep.UserJustlogAPI).Channel
-	case *justgrep.ChannelJustlogAPI:
-		channel = api.(*justgrep.ChannelJustlogAPI).Channel
+	channel := apiChannel(api)
+	progress := &justgrep.ProgressState{
+		TotalResults: make([]int, justgrep.ResultCount),
+		BeginTime:    time.Now(),
 	}
 	availableLogs, err := api.GetAvailableLogs(ctx, &httpClient)
 	if err != nil {
-		u, _ := url.Parse(*args.url)
-		fmt.Fprintf(
-			os.Stderr,
-			"Failed to fetch available logs on %s: %s",
-			u.Redacted(),
-			err,
-		)
-		os.Exit(1)
+		if ctx.Err() != nil {
+			// cancelled because -max was reached
+			return
+		}
+		// the other channels are still searched, whatever -on-error says
+		reportListError(args, channel, "Failed to fetch available logs", err, shared, progress)
+		return
 	}
 
 	toFetch, err := availableLogs.Snip(args.startTime, args.endTime)
 	if err != nil {
-		u, _ := url.Parse(*args.url)
-		fmt.Fprintf(
-			os.Stderr,
-			"Host %s returned a malformed response for logs: %s",
-			u.Redacted(),
-			err,
-		)
+		reportListError(args, channel, "Malformed response for available logs", err, shared, progress)
+	}
+
+	var prefetched <-chan justgrep.PrefetchedLog
+	if *args.jobs > 1 {
+		prefetched = justgrep.PrefetchLogEntries(ctx, api, toFetch, *args.jobs, &httpClient)
+	}
+
+	// context continues from one log file into the next
+	var contextFilter *justgrep.ContextFilter
+	if filter.ContextBefore != 0 || filter.ContextAfter != 0 {
+		contextFilter = filter.ContextFilter()
 	}
 
 	totalSteps := len(toFetch)
 	for i, entry := range toFetch {
+		if ctx.Err() != nil {
+			// -max was reached in another channel
+			break
+		}
 		stepsLeft := totalSteps - i
+		total := shared.snapshot()
 		if *args.verbose {
 			nowTime := time.Now()
-			timeTaken := float64(nowTime.Sub(progress.BeginTime) / time.Second)
+			timeTaken := float64(nowTime.Sub(total.BeginTime) / time.Second)
 			if timeTaken == 0 {
 				timeTaken = 1
 			}
@@ -474,68 +1500,394 @@ func searchLogs(
 				os.Stderr,
 				"Found %d matching messages... Downloading #%s at %s %s. %d/s (%.2f MB/s before compression). "+
 					"Processed %.2f MB (%d lines and counting)\n",
-				progress.TotalResults[justgrep.ResultOk],
+				total.TotalResults[justgrep.ResultOk],
 				channel,
 				entry.ToDate().Format("2006-01-02"),
 				makeProgressBar(float64(totalSteps), float64(stepsLeft)),
-				progress.CountLines/int(timeTaken),
-				float64(progress.CountBytes/1000/1000)/timeTaken,
+				total.CountLines/int(timeTaken),
+				float64(total.CountBytes/1000/1000)/timeTaken,
 
-				float64(progress.CountBytes/1000/1000),
-				progress.CountLines,
+				float64(total.CountBytes/1000/1000),
+				total.CountLines,
 			)
 		}
 		if *args.progressJson {
-			_ = json.NewEncoder(os.Stderr).Encode(
+			reportJson(
 				progressUpdate{
-					Type:       progressNextStep,
-					Found:      progress.TotalResults[justgrep.ResultOk],
-					Channel:    channel,
-					NextDate:   nextDate.Format(time.RFC3339),
-					TotalSteps: float64(totalSteps),
-					LeftSteps:  float64(stepsLeft),
-					Progress:   *progress,
+					Type:            progressNextStep,
+					Found:           total.TotalResults[justgrep.ResultOk],
+					Channel:         channel,
+					NextDate:        nextDate.Format(time.RFC3339),
+					TotalSteps:      float64(totalSteps),
+					LeftSteps:       float64(stepsLeft),
+					Progress:        total,
+					ChannelProgress: *progress,
 				},
 			)
 		}
+		countLines := progress.CountLines
+		countBytes := progress.CountBytes
 		download := make(chan *justgrep.Message)
-		err = justgrep.FetchForLogEntry(
-			ctx,
-			api,
-			entry,
-			download,
-			progress,
-			&httpClient,
-		)
+		// one budget for all retries of the file, including the ones of -on-error retry
+		retries := justgrep.NewRetryBudget(*args.retries)
+		if prefetched != nil {
+			fetched, ok := <-prefetched
+			if !ok {
+				// cancelled
+				break
+			}
+			retries = fetched.Retries
+			err = fetched.Err
+			if err == nil {
+				progress.CountLines += fetched.Progress.CountLines
+				progress.CountBytes += fetched.Progress.CountBytes
+				go fetched.Stream(ctx, download)
+			}
+		} else {
+			err = justgrep.FetchForLogEntry(
+				justgrep.WithRetryBudget(ctx, retries),
+				api,
+				entry,
+				download,
+				progress,
+				&httpClient,
+			)
+		}
+		entryCtx := justgrep.WithRetryBudget(ctx, retries)
+		for err != nil && *args.onError == "retry" {
+			attempt, ok := retries.Take()
+			if !ok || !justgrep.FetchRetryPolicy.Wait(ctx, api.MakeURL(entry.ToDate()), attempt, err) {
+				break
+			}
+			err = justgrep.FetchForLogEntry(entryCtx, api, entry, download, progress, &httpClient)
+		}
+		if err != nil && ctx.Err() != nil {
+			// cancelled because -max was reached, not an actual error
+			break
+		}
 		if err != nil {
 			if *args.progressJson {
-				_ = json.NewEncoder(os.Stderr).Encode(
+				reportJson(
 					errorReport{
-						Type:     errorWhileFetching,
-						Error:    err.Error(),
-						Progress: *progress,
+						Type:            errorWhileFetching,
+						Error:           err.Error(),
+						Progress:        shared.snapshot(),
+						ChannelProgress: *progress,
 					},
 				)
 			} else {
 				_, _ = fmt.Fprintf(os.Stderr, "Error while fetching logs: %s\n", err)
 			}
-			break
+			shared.fail(failedLog{Channel: channel, Date: entryDate(entry), Error: err.Error()})
+			if *args.onError == "stop" {
+				break
+			}
+			continue
+		}
+		source := download
+		download = make(chan *justgrep.Message)
+		interrupted := false
+		var refetch func(output chan *justgrep.Message, progress *justgrep.ProgressState) error
+		if *args.onError == "retry" {
+			refetch = func(output chan *justgrep.Message, progress *justgrep.ProgressState) error {
+				attempt, ok := retries.Take()
+				if !ok {
+					return errNoRetriesLeft
+				}
+				if !justgrep.FetchRetryPolicy.Wait(ctx, api.MakeURL(entry.ToDate()), attempt, errInterrupted) {
+					return ctx.Err()
+				}
+				return justgrep.FetchForLogEntry(entryCtx, api, entry, output, progress, &httpClient)
+			}
 		}
+		go watchDownload(ctx, source, download, &interrupted, refetch, progress)
 
-		filtered := make(chan *justgrep.Message)
-		var results []int
-		go func() {
-			results = filter.StreamFilter(cancel, download, filtered, progress)
-		}()
-		for msg := range filtered {
-			fmt.Println(msg.Raw)
+		// the limit is checked against results of all channels, resultWriter makes sure it's exact when channels
+		// are searched at once
+		filterProgress := &justgrep.ProgressState{TotalResults: total.TotalResults}
+		done := make(chan []int)
+		if contextFilter != nil {
+			filtered := make(chan justgrep.StreamMessage)
+			go func() {
+				done <- contextFilter.Stream(cancel, download, filtered, filterProgress)
+			}()
+			for msg := range filtered {
+				output.print(msg.Message, msg.IsContext, msg.GroupStart)
+			}
+		} else {
+			filtered := make(chan *justgrep.Message)
+			go func() {
+				done <- filter.StreamFilter(cancel, download, filtered, filterProgress)
+			}()
+			for msg := range filtered {
+				output.print(msg, false, false)
+			}
 		}
+		results := <-done
 
 		for result, count := range results {
 			progress.TotalResults[result] += count
 		}
-		if results[justgrep.ResultDateBeforeStart] != 0 || results[justgrep.ResultMaxCountReached] != 0 {
+		shared.add(results, progress.CountLines-countLines, progress.CountBytes-countBytes)
+		if contextFilter != nil {
+			// the remaining before context can be in the next file
+			if contextFilter.Done() {
+				break
+			}
+		} else if results[justgrep.ResultDateBeforeStart] != 0 || results[justgrep.ResultMaxCountReached] != 0 {
 			break
 		}
+		if interrupted {
+			shared.fail(failedLog{Channel: channel, Date: entryDate(entry), Error: errInterrupted.Error()})
+			if *args.onError == "stop" {
+				break
+			}
+		}
+	}
+}
+
+// apiChannel returns the channel searched by api, * if it searches more than one
+func apiChannel(api justgrep.JustlogAPI) string {
+	switch api := api.(type) {
+	case *justgrep.UserJustlogAPI:
+		return api.Channel
+	case *justgrep.ChannelJustlogAPI:
+		return api.Channel
+	case *justgrep.DirJustlogAPI:
+		return api.ChannelID
+	case *justgrep.FederatedJustlogAPI:
+		channel := apiChannel(api.APIs[0])
+		for _, sub := range api.APIs[1:] {
+			if apiChannel(sub) != channel {
+				return "*"
+			}
+		}
+		return channel
+	default:
+		return fmt.Sprintf("[unknown] (%t)", api)
+	}
+}
+
+var (
+	errInterrupted   = errors.New("log file couldn't be read completely")
+	errNoRetriesLeft = errors.New("no retries left")
+)
+
+// reportListError reports that the log files of channel couldn't be listed and marks the channel as failed.
+func reportListError(
+	args *arguments,
+	channel string,
+	message string,
+	err error,
+	shared *sharedProgress,
+	progress *justgrep.ProgressState,
+) {
+	if *args.progressJson {
+		reportJson(
+			errorReport{
+				Type:            errorWhileFetching,
+				Error:           err.Error(),
+				Progress:        shared.snapshot(),
+				ChannelProgress: *progress,
+			},
+		)
+	} else {
+		_, _ = fmt.Fprintf(os.Stderr, "%s of #%s: %s\n", message, channel, err)
+	}
+	shared.fail(failedLog{Channel: channel, Error: err.Error()})
+}
+
+// watchDownload forwards messages from input to output, setting interrupted if the download was cut short.
+// FetchForDate signals that with a nil message. If refetch is set, it's used to download the file again until it
+// returns errNoRetriesLeft, messages which were already forwarded are skipped. Otherwise the nil is passed on. Lines
+// of the new downloads are added to progress, except for the skipped ones.
+func watchDownload(
+	ctx context.Context,
+	input chan *justgrep.Message,
+	output chan *justgrep.Message,
+	interrupted *bool,
+	refetch func(output chan *justgrep.Message, progress *justgrep.ProgressState) error,
+	progress *justgrep.ProgressState,
+) {
+	defer close(output)
+	lastRaw := ""
+	skipping := false
+	var attemptProgress *justgrep.ProgressState
+	for {
+		cut := false
+		skippedLines, skippedBytes := 0, 0
+		for msg := range input {
+			if msg == nil {
+				cut = true
+				break
+			}
+			if skipping {
+				skipping = msg.Raw != lastRaw
+				skippedLines++
+				skippedBytes += len(msg.Raw)
+				continue
+			}
+			select {
+			case output <- msg:
+			case <-ctx.Done():
+				return
+			}
+			lastRaw = msg.Raw
+		}
+		if cut {
+			go func(input chan *justgrep.Message) {
+				for range input {
+				}
+			}(input)
+		}
+		if attemptProgress != nil {
+			progress.CountLines += attemptProgress.CountLines - skippedLines
+			progress.CountBytes += attemptProgress.CountBytes - skippedBytes
+		}
+		// not finding the last message again means the file changed
+		if !cut && !skipping {
+			return
+		}
+		for {
+			var err error
+			if refetch == nil {
+				err = errNoRetriesLeft
+			} else {
+				input = make(chan *justgrep.Message)
+				attemptProgress = &justgrep.ProgressState{TotalResults: make([]int, justgrep.ResultCount)}
+				err = refetch(input, attemptProgress)
+			}
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err == errNoRetriesLeft {
+				*interrupted = true
+				select {
+				case output <- nil:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}
+		skipping = lastRaw != ""
+	}
+}
+
+func entryDate(entry justgrep.AvailableLogEntry) string {
+	if entry.RawDay == "" {
+		return entry.ToDate().Format("2006-01")
+	}
+	return entry.ToDate().Format("2006-01-02")
+}
+
+// namesMain implements "justgrep names", listing the logins and display names a user id was seen with
+func namesMain(argv []string) {
+	flags := flag.NewFlagSet("justgrep names", flag.ExitOnError)
+	instance := flags.String("url", "", "Justlog instance URL, defaults to the first one from "+EnvDefaultInstances)
+	channel := flags.String("channel", "", "Comma separated channels to look in, names or ids prefixed with #")
+	recursive := flags.Bool("r", false, "Look in all channels of the instance")
+	user := flags.String("user", "", "User id, optionally prefixed with #")
+	start := flags.String("start", "", "Start time, defaults to the oldest logs")
+	end := flags.String("end", "", "End time, defaults to now")
+	asJson := flags.Bool("json", false, "Print a JSON array instead of a table")
+	noEnv := flags.Bool("no-env", false, "Disables reading environment variables like JUSTGREP_DEFAULT_INSTANCES")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: justgrep names -user #<id> (-channel <channels> | -r) [options]\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(argv)
+
+	userID := strings.TrimPrefix(*user, "#")
+	valid := true
+	if userID == "" || strings.Trim(userID, "0123456789") != "" {
+		_, _ = fmt.Fprintln(os.Stderr, "-user needs to be a user id.")
+		valid = false
+	}
+	if (*channel == "") == !*recursive {
+		_, _ = fmt.Fprintln(os.Stderr, "Pass either -channel or -r.")
+		valid = false
+	}
+	var startTime time.Time
+	endTime := time.Now().UTC()
+	var err error
+	if *start != "" {
+		startTime, err = parseTime(*start, time.UTC)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-start: Invalid time: %s: %s\n", *start, err)
+			valid = false
+		}
+	}
+	if *end != "" {
+		endTime, err = parseTime(*end, time.UTC)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "-end: Invalid time: %s: %s\n", *end, err)
+			valid = false
+		}
+	}
+	if !valid {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	justlogUrl := *instance
+	if justlogUrl == "" && !*noEnv {
+		justlogUrl = strings.Split(os.Getenv(EnvDefaultInstances), " ")[0]
+	}
+	if justlogUrl == "" {
+		justlogUrl = "http://localhost:8025"
+	}
+	justlogUrl = cleanUrl(justlogUrl)
+
+	ctx := context.Background()
+	chns, err := justgrep.GetChannelsFromJustLog(ctx, &httpClient, justlogUrl)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error while fetching channels from justlog: %s\n", err)
+		os.Exit(1)
+	}
+	if !*recursive {
+		var wanted justgrep.ChannelList
+		for _, name := range strings.Split(*channel, ",") {
+			var found justgrep.JustlogChannel
+			var ok bool
+			if strings.HasPrefix(name, "#") {
+				found, ok = chns.ByID(name[1:])
+			} else {
+				found, ok = chns.ByName(name)
+			}
+			if !ok {
+				_, _ = fmt.Fprintf(os.Stderr, "The justlog instance doesn't have the channel %q\n", name)
+				os.Exit(1)
+			}
+			wanted = append(wanted, found)
+		}
+		chns = wanted
+	}
+
+	history := justgrep.NewNameHistory(userID)
+	api := justgrep.NewUserHistoryAPI(justlogUrl, chns, userID, true)
+	api.Jobs = 8
+	err = justgrep.CollectNames(ctx, api, history, startTime, endTime, &httpClient)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error while fetching logs: %s\n", err)
+		os.Exit(1)
+	}
+	records := history.Records()
+	if *asJson {
+		_ = json.NewEncoder(os.Stdout).Encode(records)
+		return
+	}
+	for _, record := range records {
+		fmt.Printf(
+			"%s\t%s\t%s\t%s\t%d\t%s\n",
+			record.Login,
+			record.DisplayName,
+			record.FirstSeen.UTC().Format(time.RFC3339),
+			record.LastSeen.UTC().Format(time.RFC3339),
+			record.Count,
+			strings.Join(record.Channels, ","),
+		)
 	}
 }
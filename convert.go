@@ -0,0 +1,143 @@
+package justgrep
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MessageFromJSON decodes a Message as encoded by irc2json. If Raw is missing or doesn't match the other fields
+// anymore, e.g. because they were edited with jq, it's rebuilt from them, see Rebuild.
+func MessageFromJSON(data []byte) (*Message, error) {
+	msg := &Message{}
+	err := json.Unmarshal(data, msg)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Action == "" {
+		return nil, fmt.Errorf("message has no action: %s", data)
+	}
+	if msg.Timestamp.IsZero() {
+		// synthesized messages might only have the tags
+		msg.Timestamp = tagTimestamp(msg.Tags)
+	}
+	if msg.Stale() {
+		msg.Rebuild()
+	}
+	return msg, nil
+}
+
+// Stale reports whether Raw is empty or doesn't describe the structured fields of m.
+func (m *Message) Stale() bool {
+	if m.Raw == "" {
+		return true
+	}
+	parsed, err := NewMessage(m.Raw)
+	if err != nil {
+		return true
+	}
+	return !parsed.Equal(m)
+}
+
+// Rebuild sets Raw to the serialized structured fields. Fields which NewMessage derives from others are updated
+// first: if the prefix's nick isn't User, the nick is replaced with User (or the prefix is dropped if User is empty),
+// and the tmi-sent-ts (or time) tag is set to Timestamp. Messages without a user prefix or with a Twitch one,
+// nick!nick@nick.tmi.twitch.tv, get user!user@user.tmi.twitch.tv. Other prefixes keep their user and host parts.
+func (m *Message) Rebuild() {
+	if prefixNick(m.Prefix) != m.User {
+		source := ParseSource(m.Prefix)
+		switch {
+		case m.User == "":
+			m.Prefix = ""
+		case strings.ContainsAny(m.Prefix, "!@") && !isTwitchSource(source):
+			source.Nick = m.User
+			m.Prefix = source.String()
+		default:
+			m.Prefix = fmt.Sprintf("%s!%s@%s.tmi.twitch.tv", m.User, m.User, m.User)
+		}
+	}
+	if !m.Timestamp.IsZero() && !m.Timestamp.Equal(tagTimestamp(m.Tags)) {
+		if m.Tags == nil {
+			m.Tags = map[string]string{}
+		}
+		if _, ok := m.Tags["tmi-sent-ts"]; !ok && m.Tags["time"] != "" {
+			m.Tags["time"] = m.Timestamp.UTC().Format(time.RFC3339Nano)
+		} else {
+			m.Tags["tmi-sent-ts"] = strconv.FormatInt(m.Timestamp.UnixNano()/int64(time.Millisecond), 10)
+		}
+	}
+	m.Raw = strings.TrimSuffix(m.Serialize(), "\r\n")
+}
+
+// isTwitchSource reports whether s repeats the nick like Twitch does, nick!nick@nick.tmi.twitch.tv. Replacing only
+// the nick of those would leave the old one in the user and host parts.
+func isTwitchSource(s Source) bool {
+	return s.User == s.Nick && s.Host == s.Nick+".tmi.twitch.tv"
+}
+
+// Equal compares the structured fields of two messages, ignoring Raw.
+func (m *Message) Equal(other *Message) bool {
+	if m.Prefix != other.Prefix || m.User != other.User || m.Action != other.Action {
+		return false
+	}
+	if !m.Timestamp.Equal(other.Timestamp) {
+		return false
+	}
+	if len(m.Args) != len(other.Args) || len(m.Tags) != len(other.Tags) {
+		return false
+	}
+	for i, arg := range m.Args {
+		if other.Args[i] != arg {
+			return false
+		}
+	}
+	for key, value := range m.Tags {
+		otherValue, ok := other.Tags[key]
+		if !ok || otherValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyRoundTrip checks that parsing the serialized m gives back the same message.
+func VerifyRoundTrip(m *Message) error {
+	serialized := strings.TrimSuffix(m.Serialize(), "\r\n")
+	parsed, err := NewMessage(serialized)
+	if err != nil {
+		return fmt.Errorf("serialized message doesn't parse: %s", err)
+	}
+	if !parsed.Equal(m) {
+		return fmt.Errorf("serialized message %q parses into something else: %s", serialized, parsed)
+	}
+	return nil
+}
+
+// prefixNick returns the nick of a prefix the same way NewMessage sets User, "" for server names without ! or @
+func prefixNick(prefix string) string {
+	if !strings.ContainsAny(prefix, "!@") {
+		return ""
+	}
+	return ParseSource(prefix).Nick
+}
+
+// tagTimestamp is the time NewMessage would read from tags, zero if it's missing or invalid
+func tagTimestamp(tags map[string]string) time.Time {
+	if ts, ok := tags["tmi-sent-ts"]; ok {
+		ms, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(ms/1000, ms%1000*1000000)
+	}
+	if ts, ok := tags["time"]; ok {
+		stamp, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			return time.Time{}
+		}
+		return stamp
+	}
+	return time.Time{}
+}
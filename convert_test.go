@@ -0,0 +1,99 @@
+package justgrep
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageFromJSON(t *testing.T) {
+	raw := "@badges=;tmi-sent-ts=1641013200000 :a!a@a.tmi.twitch.tv PRIVMSG #forsen :hello there"
+	msg, err := MessageFromJSON([]byte(`{
+		"raw": "` + raw + `",
+		"prefix": "a!a@a.tmi.twitch.tv",
+		"user": "a",
+		"args": ["#forsen", "hello there"],
+		"action": "PRIVMSG",
+		"tags": {"badges": "", "tmi-sent-ts": "1641013200000"},
+		"timestamp": "2022-01-01T05:00:00Z"
+	}`))
+	assert(t, "err", err, nil)
+	assert(t, "unchanged raw", msg.Raw, raw)
+
+	msg, err = MessageFromJSON([]byte(`{
+		"raw": "` + raw + `",
+		"prefix": "a!a@a.tmi.twitch.tv",
+		"user": "redacted",
+		"args": ["#forsen", "[removed]"],
+		"action": "PRIVMSG",
+		"tags": {"badges": "", "tmi-sent-ts": "1641013200000"},
+		"timestamp": "2022-01-01T05:00:00Z"
+	}`))
+	assert(t, "err", err, nil)
+	assert(
+		t,
+		"stale raw",
+		msg.Raw,
+		"@badges=;tmi-sent-ts=1641013200000 :redacted!redacted@redacted.tmi.twitch.tv PRIVMSG #forsen :[removed]",
+	)
+	assert(t, "round trip", VerifyRoundTrip(msg), nil)
+
+	msg, err = MessageFromJSON([]byte(`{"action": "PRIVMSG", "args": ["#a", "hi"], "timestamp": "2022-01-01T00:00:00Z"}`))
+	assert(t, "err", err, nil)
+	assert(t, "synthesized", msg.Raw, "@tmi-sent-ts=1640995200000 PRIVMSG #a :hi")
+	assert(t, "synthesized timestamp", msg.Timestamp, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	msg, err = MessageFromJSON([]byte(`{"action": "PRIVMSG", "args": ["#a", "hi"], "tags": {"tmi-sent-ts": "1000"}}`))
+	assert(t, "err", err, nil)
+	assert(t, "timestamp from tags", msg.Timestamp, time.Unix(1, 0))
+
+	_, err = MessageFromJSON([]byte(`{"args": ["#a"]}`))
+	assert(t, "no action", err != nil, true)
+}
+
+func TestRebuild(t *testing.T) {
+	for _, raw := range []string{
+		":coolguy@127.0.0.1 PRIVMSG #a :hi",
+		":coolguy!~cool@127.0.0.1 PRIVMSG #a :hi",
+		":tmi.twitch.tv PRIVMSG #a :hi",
+	} {
+		msg, err := NewMessage(raw)
+		assert(t, "err", err, nil)
+		assert(t, "stale "+raw, msg.Stale(), false)
+		msg.Rebuild()
+		assert(t, "rebuilt "+raw, msg.Raw, raw)
+	}
+
+	// only the nick is replaced, unless the prefix is a Twitch one
+	msg, err := NewMessage(":coolguy!coolguy@coolguy.tmi.twitch.tv PRIVMSG #a :hi")
+	assert(t, "err", err, nil)
+	msg.User = "other"
+	msg.Rebuild()
+	assert(t, "new Twitch prefix", msg.Raw, ":other!other@other.tmi.twitch.tv PRIVMSG #a :hi")
+	msg, err = NewMessage(":coolguy!~cool@127.0.0.1 PRIVMSG #a :hi")
+	assert(t, "err", err, nil)
+	msg.User = "other"
+	msg.Rebuild()
+	assert(t, "new nick", msg.Raw, ":other!~cool@127.0.0.1 PRIVMSG #a :hi")
+	msg.Prefix = "coolguy@127.0.0.1"
+	msg.Rebuild()
+	assert(t, "new nick without user", msg.Raw, ":other@127.0.0.1 PRIVMSG #a :hi")
+
+	// the Twitch form is only used without a user prefix
+	for _, prefix := range []string{"", "tmi.twitch.tv"} {
+		msg = &Message{Prefix: prefix, User: "other", Action: "PRIVMSG", Args: []string{"#a", "hi"}}
+		msg.Rebuild()
+		assert(t, "new prefix for "+prefix, msg.Raw, ":other!other@other.tmi.twitch.tv PRIVMSG #a :hi")
+	}
+	msg.User = ""
+	msg.Rebuild()
+	assert(t, "no user", msg.Raw, "PRIVMSG #a :hi")
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	msg := &Message{Action: "PRIVMSG", Args: []string{"#a", "b c", "d"}}
+	assert(t, "space in middle argument", VerifyRoundTrip(msg) != nil, true)
+
+	msg, err := NewMessage("@a=b\\sc;d=e :x!x@x PRIVMSG #a :hi")
+	assert(t, "err", err, nil)
+	assert(t, "parsed message", VerifyRoundTrip(msg), nil)
+}
@@ -0,0 +1,93 @@
+package justgrep
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GroupFunc extracts the key a message is counted under.
+type GroupFunc func(msg *Message) string
+
+// ParseGroupBy returns a GroupFunc for a group by specification: user, channel, hour, day, type or tag:<name>.
+// Times are grouped in location. The second return value tells if the keys are time buckets.
+func ParseGroupBy(spec string, location *time.Location) (GroupFunc, bool, error) {
+	switch spec {
+	case "user":
+		return func(msg *Message) string {
+			return msg.User
+		}, false, nil
+	case "channel":
+		return func(msg *Message) string {
+			if len(msg.Args) == 0 {
+				return ""
+			}
+			return strings.TrimPrefix(msg.Args[0], "#")
+		}, false, nil
+	case "hour":
+		return func(msg *Message) string {
+			return msg.Timestamp.In(location).Format("2006-01-02 15:00")
+		}, true, nil
+	case "day":
+		return func(msg *Message) string {
+			return msg.Timestamp.In(location).Format("2006-01-02")
+		}, true, nil
+	case "type":
+		return func(msg *Message) string {
+			return msg.Action
+		}, false, nil
+	}
+	if strings.HasPrefix(spec, "tag:") {
+		name := spec[len("tag:"):]
+		if name == "" {
+			return nil, false, errors.New("missing tag name after tag:")
+		}
+		return func(msg *Message) string {
+			return msg.Tags[name]
+		}, false, nil
+	}
+	return nil, false, fmt.Errorf("unknown group %q, expected user, channel, hour, day, type or tag:<name>", spec)
+}
+
+// Counter counts messages grouped by a key.
+type Counter struct {
+	Group GroupFunc
+	// ByKey makes Sorted order entries by key instead of by count, useful for time buckets
+	ByKey bool
+
+	Counts map[string]int
+}
+
+type CounterEntry struct {
+	Key   string
+	Count int
+}
+
+func NewCounter(group GroupFunc, byKey bool) *Counter {
+	return &Counter{
+		Group:  group,
+		ByKey:  byKey,
+		Counts: make(map[string]int),
+	}
+}
+
+func (c *Counter) Add(msg *Message) {
+	c.Counts[c.Group(msg)]++
+}
+
+// Sorted returns all groups ordered by descending count (ties by key) or by key if c.ByKey is set.
+func (c *Counter) Sorted() []CounterEntry {
+	entries := make([]CounterEntry, 0, len(c.Counts))
+	for key, count := range c.Counts {
+		entries = append(entries, CounterEntry{Key: key, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !c.ByKey && entries[i].Count != entries[j].Count {
+			return entries[i].Count > entries[j].Count
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries
+}
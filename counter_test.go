@@ -0,0 +1,49 @@
+package justgrep
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCounter(t *testing.T) {
+	group, byKey, err := ParseGroupBy("user", time.UTC)
+	assert(t, "err", err, nil)
+	assert(t, "byKey", byKey, false)
+	c := NewCounter(group, byKey)
+	for _, user := range []string{"b", "a", "c", "a", "c", "a"} {
+		msg := getTestMessage()
+		msg.User = user
+		c.Add(msg)
+	}
+	assert(t, "sorted", fmt.Sprint(c.Sorted()), "[{a 3} {c 2} {b 1}]")
+
+	group, byKey, err = ParseGroupBy("day", time.UTC)
+	assert(t, "err", err, nil)
+	assert(t, "byKey", byKey, true)
+	assert(t, "day", group(getTestMessage()), "2021-09-19")
+
+	// buckets follow the time zone, 15:42 UTC is already the next day at UTC+11
+	zone := time.FixedZone("UTC+11", 11*60*60)
+	group, _, err = ParseGroupBy("day", zone)
+	assert(t, "err", err, nil)
+	assert(t, "day in zone", group(getTestMessage()), "2021-09-20")
+	group, _, err = ParseGroupBy("hour", zone)
+	assert(t, "err", err, nil)
+	assert(t, "hour in zone", group(getTestMessage()), "2021-09-20 02:00")
+
+	group, _, err = ParseGroupBy("channel", time.UTC)
+	assert(t, "err", err, nil)
+	assert(t, "channel", group(getTestMessage()), "pajlada")
+
+	group, _, err = ParseGroupBy("tag:room-id", time.UTC)
+	assert(t, "err", err, nil)
+	assert(t, "tag", group(getTestMessage()), "11148817")
+
+	for _, spec := range []string{"", "tag:", "month"} {
+		_, _, err = ParseGroupBy(spec, time.UTC)
+		if err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package justgrep
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogFileOpener is implemented by JustlogAPIs which can read log files without going through HTTP. FetchForDate uses
+// it instead of downloading MakeURL.
+type LogFileOpener interface {
+	// OpenLogFile returns the log file starting at date, newest messages first like justlog's ?reverse.
+	OpenLogFile(ctx context.Context, date time.Time) (io.ReadCloser, error)
+}
+
+// DirJustlogAPI reads logs straight from a justlog logs directory, laid out as
+// <channel id>/<year>/<month>/<day>/channel.txt for channel logs and <channel id>/<year>/<month>/<user id>.txt for
+// user logs. Files compressed by justlog (.txt.gz) are read as well.
+type DirJustlogAPI struct {
+	Dir       string
+	ChannelID string
+
+	// UserID makes the api read per-user logs
+	UserID string
+}
+
+func (api DirJustlogAPI) isUser() bool {
+	return api.UserID != ""
+}
+
+// MakeURL returns the path of the uncompressed log file.
+func (api DirJustlogAPI) MakeURL(date time.Time) string {
+	if api.isUser() {
+		return filepath.Join(
+			api.Dir,
+			api.ChannelID,
+			strconv.Itoa(date.Year()),
+			strconv.Itoa(int(date.Month())),
+			api.UserID+".txt",
+		)
+	}
+	return filepath.Join(
+		api.Dir,
+		api.ChannelID,
+		strconv.Itoa(date.Year()),
+		strconv.Itoa(int(date.Month())),
+		strconv.Itoa(date.Day()),
+		"channel.txt",
+	)
+}
+
+func (api DirJustlogAPI) NextLogFile(currentDate time.Time) time.Time {
+	if api.isUser() {
+		return currentDate.AddDate(0, -1, 0)
+	}
+	return currentDate.AddDate(0, 0, -1)
+}
+
+func (api DirJustlogAPI) GetApproximateOffset() time.Duration {
+	if api.isUser() {
+		return time.Hour * 24 * 30
+	}
+	return time.Hour * 24
+}
+
+// GetAvailableLogs lists log files in the directory, newest first. The client is unused.
+func (api DirJustlogAPI) GetAvailableLogs(ctx context.Context, client *http.Client) (LogsList, error) {
+	channelDir := filepath.Join(api.Dir, api.ChannelID)
+	if _, err := os.Stat(channelDir); err != nil {
+		return nil, err
+	}
+	var out LogsList
+	years, err := numericSubdirs(channelDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, year := range years {
+		yearDir := filepath.Join(channelDir, year)
+		months, err := numericSubdirs(yearDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, month := range months {
+			monthDir := filepath.Join(yearDir, month)
+			if api.isUser() {
+				if logFileExists(filepath.Join(monthDir, api.UserID+".txt")) {
+					out = append(out, AvailableLogEntry{RawYear: year, RawMonth: month})
+				}
+				continue
+			}
+			days, err := numericSubdirs(monthDir)
+			if err != nil {
+				return nil, err
+			}
+			for _, day := range days {
+				if logFileExists(filepath.Join(monthDir, day, "channel.txt")) {
+					out = append(out, AvailableLogEntry{RawYear: year, RawMonth: month, RawDay: day})
+				}
+			}
+		}
+	}
+	err = out.EnsureParsed()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].ToDate().After(out[j].ToDate())
+	})
+	return out, nil
+}
+
+// OpenLogFile reads the whole file and returns its lines in reverse order.
+func (api DirJustlogAPI) OpenLogFile(ctx context.Context, date time.Time) (io.ReadCloser, error) {
+	path := api.MakeURL(date)
+	var reader io.Reader
+	file, err := os.Open(path + ".gz")
+	if err == nil {
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s.gz: %s", path, err)
+		}
+		defer gz.Close()
+		reader = gz
+	} else {
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	buf := bytes.Buffer{}
+	for i := len(lines) - 1; i >= 0; i-- {
+		buf.Write(lines[i])
+		buf.WriteByte('\n')
+	}
+	return io.NopCloser(&buf), nil
+}
+
+// GetChannelsFromDir lists channel ids which have logs in a justlog logs directory.
+func GetChannelsFromDir(dir string) ([]string, error) {
+	return numericSubdirs(dir)
+}
+
+func logFileExists(path string) bool {
+	if _, err := os.Stat(path + ".gz"); err == nil {
+		return true
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// numericSubdirs lists directories with names made of digits only, justlog uses those for ids and dates.
+func numericSubdirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.Trim(entry.Name(), "0123456789") != "" {
+			continue
+		}
+		out = append(out, entry.Name())
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package justgrep
+
+import (
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeLogFile(t *testing.T, path string, data string, compress bool) {
+	assert(t, "mkdir err", os.MkdirAll(filepath.Dir(path), 0o755), nil)
+	if !compress {
+		assert(t, "write err", os.WriteFile(path, []byte(data), 0o644), nil)
+		return
+	}
+	file, err := os.Create(path + ".gz")
+	assert(t, "create err", err, nil)
+	gz := gzip.NewWriter(file)
+	_, err = gz.Write([]byte(data))
+	assert(t, "write err", err, nil)
+	assert(t, "gzip close err", gz.Close(), nil)
+	assert(t, "close err", file.Close(), nil)
+}
+
+func TestDirJustlogAPI(t *testing.T) {
+	dir := t.TempDir()
+	writeLogFile(
+		t,
+		filepath.Join(dir, "11148817", "2022", "1", "2", "channel.txt"),
+		"@tmi-sent-ts=1641081600000 :a!a@a PRIVMSG #pajlada :first\n"+
+			"@tmi-sent-ts=1641081601000 :a!a@a PRIVMSG #pajlada :second\n",
+		true,
+	)
+	writeLogFile(
+		t,
+		filepath.Join(dir, "11148817", "2022", "1", "10", "channel.txt"),
+		"@tmi-sent-ts=1641772800000 :a!a@a PRIVMSG #pajlada :later\n",
+		false,
+	)
+	writeLogFile(t, filepath.Join(dir, "11148817", "2021", "12", "117691339.txt"), "", false)
+
+	channels, err := GetChannelsFromDir(dir)
+	assert(t, "err", err, nil)
+	assertStrSlc(t, "channels", channels, []string{"11148817"})
+
+	api := DirJustlogAPI{Dir: dir, ChannelID: "11148817"}
+	logs, err := api.GetAvailableLogs(context.Background(), nil)
+	assert(t, "err", err, nil)
+	assert(t, "log count", len(logs), 2)
+	assert(t, "newest first", logs[0].Day, 10)
+	assert(t, "oldest last", logs[1].Day, 2)
+
+	output := make(chan *Message)
+	progress := &ProgressState{TotalResults: make([]int, ResultCount)}
+	err = FetchForLogEntry(context.Background(), api, logs[1], output, progress, nil)
+	assert(t, "err", err, nil)
+	var texts []string
+	for msg := range output {
+		texts = append(texts, msg.Args[1])
+	}
+	assertStrSlc(t, "reversed messages", texts, []string{"second", "first"})
+
+	userApi := DirJustlogAPI{Dir: dir, ChannelID: "11148817", UserID: "117691339"}
+	logs, err = userApi.GetAvailableLogs(context.Background(), nil)
+	assert(t, "err", err, nil)
+	assert(t, "user log count", len(logs), 1)
+	assert(t, "user log month", logs[0].Month, 12)
+}
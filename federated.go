@@ -0,0 +1,330 @@
+package justgrep
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// dedupeWindow is how far out of order the same message can be in the logs of different instances
+const dedupeWindow = time.Minute
+
+// MessageFetcher is implemented by JustlogAPIs which produce messages themselves. FetchForDate uses it instead of
+// downloading MakeURL.
+type MessageFetcher interface {
+	// FetchMessages works like FetchForDate.
+	FetchMessages(
+		ctx context.Context,
+		date time.Time,
+		output chan *Message,
+		progress *ProgressState,
+		client *http.Client,
+	) error
+}
+
+// FederatedJustlogAPI searches several justlog instances logging the same channel or user. Log files are downloaded
+// from every instance that has them and merged newest first, messages logged by more than one instance are only
+// returned once. Duplicates are found using the id tag, or the raw line for messages without one.
+//
+// All APIs have to be of the same kind, so that their log files cover the same time.
+type FederatedJustlogAPI struct {
+	APIs []JustlogAPI
+	// Instances names every api in Message.Instances
+	Instances []string
+	// Jobs limits how many APIs are asked for their logs or downloaded from at once, 0 means all of them
+	Jobs int
+
+	lock sync.Mutex
+	// available lists indexes of APIs having the log file starting at a date
+	available map[time.Time][]int
+}
+
+func (api *FederatedJustlogAPI) MakeURL(date time.Time) string {
+	return api.APIs[0].MakeURL(date)
+}
+
+func (api *FederatedJustlogAPI) NextLogFile(currentDate time.Time) time.Time {
+	return api.APIs[0].NextLogFile(currentDate)
+}
+
+func (api *FederatedJustlogAPI) GetApproximateOffset() time.Duration {
+	return api.APIs[0].GetApproximateOffset()
+}
+
+// GetAvailableLogs returns log files available on any of the instances. Instances which fail to list their logs are
+// left out, an error is only returned if all of them fail.
+func (api *FederatedJustlogAPI) GetAvailableLogs(ctx context.Context, client *http.Client) (LogsList, error) {
+	lists := make([]LogsList, len(api.APIs))
+	errs := make([]error, len(api.APIs))
+	jobs := api.Jobs
+	if jobs <= 0 {
+		jobs = len(api.APIs)
+	}
+	slots := make(chan struct{}, jobs)
+	wg := sync.WaitGroup{}
+	for i, sub := range api.APIs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, sub JustlogAPI) {
+			defer wg.Done()
+			defer func() {
+				<-slots
+			}()
+			lists[i], errs[i] = sub.GetAvailableLogs(ctx, client)
+			if errs[i] == nil {
+				errs[i] = lists[i].EnsureParsed()
+			}
+		}(i, sub)
+	}
+	wg.Wait()
+
+	available := map[time.Time][]int{}
+	var out LogsList
+	var firstErr error
+	for i, list := range lists {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		for _, entry := range list {
+			date := entry.ToDate()
+			if _, ok := available[date]; !ok {
+				out = append(out, entry)
+			}
+			available[date] = append(available[date], i)
+		}
+	}
+	if len(available) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].ToDate().After(out[j].ToDate())
+	})
+
+	api.lock.Lock()
+	api.available = available
+	api.lock.Unlock()
+	return out, nil
+}
+
+// RedactURL hides the password of url so it can be used to name an instance in the output.
+func RedactURL(instance string) string {
+	u, err := url.Parse(instance)
+	if err != nil {
+		return "[failed to url parse, hiding to not show any secrets]"
+	}
+	return u.Redacted()
+}
+
+// sources returns indexes of APIs to download the log file from, all of them if GetAvailableLogs wasn't called.
+func (api *FederatedJustlogAPI) sources(date time.Time) []int {
+	api.lock.Lock()
+	defer api.lock.Unlock()
+	if api.available != nil {
+		return api.available[date]
+	}
+	out := make([]int, len(api.APIs))
+	for i := range out {
+		out[i] = i
+	}
+	return out
+}
+
+// FetchMessages downloads the log file from every instance having it and merges them. Instances which fail are
+// skipped, an error is only returned if all of them do. If Jobs limits the downloads, each file is read completely
+// before the next one is started, so FetchMessages only returns once the last ones are running.
+func (api *FederatedJustlogAPI) FetchMessages(
+	ctx context.Context,
+	date time.Time,
+	output chan *Message,
+	progress *ProgressState,
+	client *http.Client,
+) error {
+	sources := api.sources(date)
+	if len(sources) == 0 {
+		return errors.New("no instance has logs for " + date.Format("2006-01-02"))
+	}
+	var inputs []chan *Message
+	var names []string
+	var progresses []*ProgressState
+	var firstErr error
+	// MergeMessages needs a message from every input, so limited downloads are buffered
+	limited := api.Jobs > 0 && api.Jobs < len(sources)
+	slots := make(chan struct{}, api.Jobs)
+	for _, i := range sources {
+		if limited {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		input := make(chan *Message)
+		sourceProgress := &ProgressState{TotalResults: make([]int, ResultCount)}
+		_, err := FetchForDate(ctx, api.APIs[i], date, input, sourceProgress, client)
+		if err != nil {
+			if limited {
+				<-slots
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if limited {
+			input = bufferMessages(ctx, input, slots)
+		}
+		inputs = append(inputs, input)
+		names = append(names, api.Instances[i])
+		progresses = append(progresses, sourceProgress)
+	}
+	if len(inputs) == 0 {
+		return firstErr
+	}
+	go func() {
+		MergeMessages(ctx, inputs, names, output)
+		// when cancelled, downloads might still be running
+		if ctx.Err() == nil {
+			for _, sourceProgress := range progresses {
+				progress.CountLines += sourceProgress.CountLines
+				progress.CountBytes += sourceProgress.CountBytes
+			}
+		}
+		close(output)
+	}()
+	return nil
+}
+
+// MergeMessages merges streams of messages sorted newest first into output, removing duplicates and setting
+// Message.Instances to the names of the inputs the message came from. A nil message ends its input like the end of the
+// stream, the other inputs are still read. output isn't closed.
+func MergeMessages(ctx context.Context, inputs []chan *Message, names []string, output chan *Message) {
+	heads := make([]*Message, len(inputs))
+	next := func(i int) {
+		heads[i] = nil
+		msg, ok := <-inputs[i]
+		if ok && msg != nil {
+			heads[i] = msg
+			return
+		}
+		if ok {
+			drainAll(inputs[i : i+1])
+		}
+	}
+	for i := range inputs {
+		next(i)
+	}
+
+	type seenMessage struct {
+		key       string
+		timestamp time.Time
+	}
+	seen := map[string]*Message{}
+	var order []seenMessage
+	// messages with the same timestamp are held back until all their sources are known, they can't be changed after
+	// being sent
+	var pending []*Message
+	flush := func() bool {
+		for _, msg := range pending {
+			select {
+			case output <- msg:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		pending = pending[:0]
+		return true
+	}
+	for {
+		newest := -1
+		for i, head := range heads {
+			if head != nil && (newest == -1 || head.Timestamp.After(heads[newest].Timestamp)) {
+				newest = i
+			}
+		}
+		if newest == -1 {
+			break
+		}
+		msg := heads[newest]
+		next(newest)
+
+		if len(pending) != 0 && !pending[0].Timestamp.Equal(msg.Timestamp) && !flush() {
+			drainAll(inputs)
+			return
+		}
+		for len(order) != 0 && order[0].timestamp.Sub(msg.Timestamp) > dedupeWindow {
+			delete(seen, order[0].key)
+			order = order[1:]
+		}
+		key := dedupeKey(msg)
+		if first, ok := seen[key]; ok {
+			for _, held := range pending {
+				if held == first {
+					addSource(first, names[newest])
+				}
+			}
+			continue
+		}
+		seen[key] = msg
+		order = append(order, seenMessage{key: key, timestamp: msg.Timestamp})
+		addSource(msg, names[newest])
+		pending = append(pending, msg)
+	}
+	flush()
+	drainAll(inputs)
+}
+
+// bufferMessages reads all of input before passing it on and frees a slot once it's done
+func bufferMessages(ctx context.Context, input chan *Message, slots chan struct{}) chan *Message {
+	output := make(chan *Message)
+	go func() {
+		defer close(output)
+		var messages []*Message
+		for msg := range input {
+			messages = append(messages, msg)
+		}
+		<-slots
+		for _, msg := range messages {
+			select {
+			case output <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return output
+}
+
+// drainAll reads the rest of every input so downloads can finish
+func drainAll(inputs []chan *Message) {
+	for _, input := range inputs {
+		go func(input chan *Message) {
+			for range input {
+			}
+		}(input)
+	}
+}
+
+func dedupeKey(msg *Message) string {
+	if id, ok := msg.Tags["id"]; ok && id != "" {
+		return "id:" + id
+	}
+	sum := sha256.Sum256([]byte(msg.Raw))
+	return "raw:" + string(sum[:])
+}
+
+func addSource(msg *Message, name string) {
+	for _, source := range msg.Instances {
+		if source == name {
+			return
+		}
+	}
+	msg.Instances = append(msg.Instances, name)
+}
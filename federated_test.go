@@ -0,0 +1,107 @@
+package justgrep
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeInstance serves the given days of 2022-01, with one line per given second, newest first
+func newFakeInstance(days []int, seconds []int, withIds bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list" {
+			var logs []map[string]string
+			for _, day := range days {
+				logs = append(logs, map[string]string{"year": "2022", "month": "1", "day": fmt.Sprint(day)})
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"availableLogs": logs})
+			return
+		}
+		for _, second := range seconds {
+			ts := time.Date(2022, 1, 1, 0, 0, second, 0, time.UTC).UnixNano() / 1e6
+			if withIds {
+				_, _ = fmt.Fprintf(w, "@id=msg%d;tmi-sent-ts=%d :a!a@a PRIVMSG #test :line %d\n", second, ts, second)
+			} else {
+				_, _ = fmt.Fprintf(w, "@tmi-sent-ts=%d :a!a@a PRIVMSG #test :line %d\n", ts, second)
+			}
+		}
+	}))
+}
+
+func TestMergeMessages(t *testing.T) {
+	first := newFakeInstance([]int{2, 1}, []int{50, 40, 30}, true)
+	defer first.Close()
+	second := newFakeInstance([]int{3, 1}, []int{45, 40, 20}, true)
+	defer second.Close()
+
+	api := &FederatedJustlogAPI{
+		APIs: []JustlogAPI{
+			&ChannelJustlogAPI{Channel: "test", URL: first.URL},
+			&ChannelJustlogAPI{Channel: "test", URL: second.URL},
+		},
+		Instances: []string{"first", "second"},
+	}
+	logs, err := api.GetAvailableLogs(context.Background(), first.Client())
+	assert(t, "err", err, nil)
+	assert(t, "log count", len(logs), 3)
+	assert(t, "newest log", logs[0].Day, 3)
+
+	output := make(chan *Message)
+	progress := &ProgressState{TotalResults: make([]int, ResultCount)}
+	_, err = FetchForDate(context.Background(), api, logs[2].ToDate(), output, progress, first.Client())
+	assert(t, "err", err, nil)
+	var lines []string
+	for msg := range output {
+		lines = append(lines, msg.Args[1]+" "+strings.Join(msg.Instances, ","))
+	}
+	assert(
+		t,
+		"merged lines",
+		strings.Join(lines, ","),
+		"line 50 first,line 45 second,line 40 first,second,line 30 first,line 20 second",
+	)
+	assert(t, "line count", progress.CountLines, 6)
+
+	// only the instance having the file is asked
+	output = make(chan *Message)
+	_, err = FetchForDate(context.Background(), api, logs[0].ToDate(), output, progress, first.Client())
+	assert(t, "err", err, nil)
+	count := 0
+	for msg := range output {
+		assert(t, "source", strings.Join(msg.Instances, ","), "second")
+		_, ok := msg.Tags["justgrep/instances"]
+		assert(t, "has instances tag", ok, false)
+		count++
+	}
+	assert(t, "message count", count, 3)
+}
+
+func TestMergeMessagesWithoutIds(t *testing.T) {
+	first := newFakeInstance([]int{1}, []int{30, 10}, false)
+	defer first.Close()
+	second := newFakeInstance([]int{1}, []int{30, 20, 10}, false)
+	defer second.Close()
+
+	api := &FederatedJustlogAPI{
+		APIs: []JustlogAPI{
+			&ChannelJustlogAPI{Channel: "test", URL: first.URL},
+			&ChannelJustlogAPI{Channel: "test", URL: second.URL},
+		},
+		Instances: []string{"first", "second"},
+	}
+	output := make(chan *Message)
+	progress := &ProgressState{TotalResults: make([]int, ResultCount)}
+	date := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := FetchForDate(context.Background(), api, date, output, progress, first.Client())
+	assert(t, "err", err, nil)
+	var lines []string
+	for msg := range output {
+		lines = append(lines, msg.Args[1]+" "+strings.Join(msg.Instances, ","))
+	}
+	assert(t, "merged lines", strings.Join(lines, ","), "line 30 first,second,line 20 second,line 10 first,second")
+}
@@ -3,6 +3,7 @@ package justgrep
 import (
 	"context"
 	"regexp"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -26,6 +27,9 @@ type Filter struct {
 	HasMessageRegex bool
 	MessageRegex    *regexp.Regexp
 
+	HasPatterns bool
+	Patterns    *PatternSet
+
 	UserMatchType UserMatchType
 
 	UserRegex         *regexp.Regexp
@@ -33,7 +37,21 @@ type Filter struct {
 	UserName          string
 	NegativeUserName  string
 
+	// Tags are all required to match
+	Tags []TagPredicate
+
+	HasQuery bool
+	Query    *Query
+
+	// Predicates are additional checks performed after all the built-in ones
+	Predicates []Predicate
+
 	Count int
+
+	// ContextBefore and ContextAfter are the numbers of older and newer messages emitted around every match by
+	// StreamFilterContext.
+	ContextBefore int
+	ContextAfter  int
 }
 type FilterResult uint8
 
@@ -45,6 +63,7 @@ const (
 	ResultContent
 	ResultUser
 	ResultMaxCountReached
+	ResultTag
 
 	ResultCount
 )
@@ -65,19 +84,35 @@ func (res FilterResult) String() string {
 		return "user"
 	case ResultMaxCountReached:
 		return "limit reached"
+	case ResultTag:
+		return "tag"
 	default:
 		return strconv.FormatInt(int64(res), 10)
 	}
 }
 
 // StreamFilter performs Filter on every message from the input channel and puts every message that matched onto the
-// output channel, if the max count of results is reached cancel() is called and results[ResultsMaxCountReached] is set.
-// If the messages are too old, cancel() is called and results[ResultDateBeforeStart] is set.
+// output channel, see StreamPredicate.
 func (f Filter) StreamFilter(
 	cancel context.CancelFunc,
 	input chan *Message,
 	output chan *Message,
 	progress *ProgressState,
+) []int {
+	return StreamPredicate(f.Predicate(), f.Count, cancel, input, output, progress)
+}
+
+// StreamPredicate checks every message from the input channel against predicate and puts every message that matched
+// onto the output channel, if the max count of results is reached cancel() is called and
+// results[ResultsMaxCountReached] is set. Count set to 0 means no limit.
+// If the messages are too old, cancel() is called and results[ResultDateBeforeStart] is set.
+func StreamPredicate(
+	predicate Predicate,
+	count int,
+	cancel context.CancelFunc,
+	input chan *Message,
+	output chan *Message,
+	progress *ProgressState,
 ) []int {
 	results := make([]int, ResultCount)
 	for msg := range input {
@@ -85,12 +120,12 @@ func (f Filter) StreamFilter(
 			break
 		}
 
-		if f.Count != 0 && progress.TotalResults[ResultOk]+results[ResultOk] >= f.Count {
+		if count != 0 && progress.TotalResults[ResultOk]+results[ResultOk] >= count {
 			results[ResultMaxCountReached] = 1
 			cancel() // HTTP request is still going, kill it
 			break
 		}
-		result := f.Filter(msg)
+		result := predicate.Filter(msg)
 		results[result]++
 		if result == ResultOk {
 			output <- msg
@@ -104,49 +139,266 @@ func (f Filter) StreamFilter(
 	return results
 }
 
-// Filter performs all checks necessary to know if a given msg matches the Filter predicates.
-func (f Filter) Filter(msg *Message) FilterResult {
-	if msg.Timestamp.After(f.EndDate) {
-		return ResultDateAfterEnd
+// StreamMessage is a message emitted by StreamFilterContext.
+type StreamMessage struct {
+	*Message
+
+	// IsContext is set if the message didn't match and is only there because it's next to one that did.
+	IsContext bool
+
+	// GroupStart is set on the first message of a group of matches and their context which isn't directly adjacent to
+	// the previously emitted message.
+	GroupStart bool
+}
+
+// StreamFilterContext works like StreamFilter, but also emits f.ContextBefore older and f.ContextAfter newer messages
+// around every match, see StreamPredicateContext.
+func (f Filter) StreamFilterContext(
+	cancel context.CancelFunc,
+	input chan *Message,
+	output chan StreamMessage,
+	progress *ProgressState,
+) []int {
+	return StreamPredicateContext(
+		f.Predicate(),
+		f.Count,
+		f.ContextBefore,
+		f.ContextAfter,
+		cancel,
+		input,
+		output,
+		progress,
+	)
+}
+
+type indexedMessage struct {
+	idx int
+	msg *Message
+}
+
+// StreamPredicateContext works like StreamPredicate, but also emits context messages from the same input stream around
+// every match, see ContextFilter. Context isn't carried over to other streams.
+func StreamPredicateContext(
+	predicate Predicate,
+	count int,
+	before int,
+	after int,
+	cancel context.CancelFunc,
+	input chan *Message,
+	output chan StreamMessage,
+	progress *ProgressState,
+) []int {
+	return NewContextFilter(predicate, count, before, after).Stream(cancel, input, output, progress)
+}
+
+// ContextFilter emits Before older and After newer messages around every match of Predicate. Its state is kept
+// between calls to Stream, so context spans consecutive streams of the same log, like the log files of a channel
+// passed one after another.
+type ContextFilter struct {
+	Predicate Predicate
+	// Count is the max number of results, 0 means no limit
+	Count  int
+	Before int
+	After  int
+
+	// newer messages which might become after context of a later match
+	recent        []indexedMessage
+	pendingBefore int
+	idx           int
+	lastEmitted   int
+	stopping      bool
+}
+
+func NewContextFilter(predicate Predicate, count int, before int, after int) *ContextFilter {
+	return &ContextFilter{
+		Predicate:   predicate,
+		Count:       count,
+		Before:      before,
+		After:       after,
+		recent:      make([]indexedMessage, 0, after),
+		idx:         -1,
+		lastEmitted: -1,
 	}
+}
+
+// ContextFilter makes a ContextFilter with the checks, count and context sizes of f.
+func (f Filter) ContextFilter() *ContextFilter {
+	return NewContextFilter(f.Predicate(), f.Count, f.ContextBefore, f.ContextAfter)
+}
+
+// Done reports whether the filter stopped because the count or the start date was reached and all remaining before
+// context was emitted. Further streams don't need to be read.
+func (c *ContextFilter) Done() bool {
+	return c.stopping && c.pendingBefore == 0
+}
 
-	if msg.Timestamp.Before(f.StartDate) {
-		return ResultDateBeforeStart
+// Stream checks the messages of input and puts matches and their context onto output, which is closed at the end. The
+// input is expected to be in justlog's ?reverse order (newest first), so the before (older) context of a match is read
+// after it and the after (newer) context is read before it. Messages are emitted in input order.
+//
+// Context messages aren't counted as results, when count or the start date is reached the remaining before context
+// of the last match is still emitted, from the next stream if needed. A nil message ends the stream like in
+// StreamPredicate, context doesn't continue over the skipped part.
+func (c *ContextFilter) Stream(
+	cancel context.CancelFunc,
+	input chan *Message,
+	output chan StreamMessage,
+	progress *ProgressState,
+) []int {
+	results := make([]int, ResultCount)
+	emit := func(idx int, msg *Message, isContext bool) {
+		output <- StreamMessage{
+			Message:    msg,
+			IsContext:  isContext,
+			GroupStart: c.lastEmitted == -1 || idx != c.lastEmitted+1,
+		}
+		c.lastEmitted = idx
 	}
-	if f.HasMessageType {
-		ok := false
-		for _, messageType := range f.MessageTypes {
-			if messageType == msg.Action {
-				ok = true
+
+	for msg := range input {
+		if msg == nil {
+			// the rest of the stream is missing
+			c.idx++
+			c.recent = c.recent[:0]
+			c.pendingBefore = 0
+			break
+		}
+		c.idx++
+
+		if !c.stopping && c.Count != 0 && progress.TotalResults[ResultOk]+results[ResultOk] >= c.Count {
+			results[ResultMaxCountReached] = 1
+			c.stopping = true
+		}
+		if c.stopping {
+			if c.pendingBefore == 0 {
+				cancel() // HTTP request is still going, kill it
 				break
 			}
+			emit(c.idx, msg, true)
+			c.pendingBefore--
+			continue
 		}
-		if !ok {
-			return ResultType
+
+		result := c.Predicate.Filter(msg)
+		results[result]++
+		if result == ResultOk {
+			for _, m := range c.recent {
+				emit(m.idx, m.msg, true)
+			}
+			c.recent = c.recent[:0]
+			emit(c.idx, msg, false)
+			c.pendingBefore = c.Before
+		} else if c.pendingBefore > 0 {
+			emit(c.idx, msg, true)
+			c.pendingBefore--
+		} else if c.After > 0 {
+			if len(c.recent) == c.After {
+				copy(c.recent, c.recent[1:])
+				c.recent = c.recent[:c.After-1]
+			}
+			c.recent = append(c.recent, indexedMessage{idx: c.idx, msg: msg})
 		}
+
+		if result == ResultDateBeforeStart {
+			c.stopping = true
+			if c.pendingBefore == 0 {
+				cancel() // HTTP request is still going, kill it
+				break
+			}
+		}
+	}
+	close(output)
+	return results
+}
+
+// Predicate combines all checks configured in the Filter into a single Predicate. The date check is always first.
+func (f Filter) Predicate() Predicate {
+	predicates := []Predicate{DatePredicate{Start: f.StartDate, End: f.EndDate}}
+	if f.HasMessageType {
+		predicates = append(predicates, TypePredicate(f.MessageTypes))
 	}
-	if f.HasMessageRegex && !f.MessageRegex.MatchString(msg.Args[len(msg.Args)-1]) {
-		return ResultContent
+	if f.HasMessageRegex {
+		predicates = append(predicates, ContentPredicate{Regex: f.MessageRegex})
 	}
-	switch f.UserMatchType {
-	case DontMatch:
-		break
-	case MatchRegex:
-		if f.UserName != "" && !f.UserRegex.MatchString(msg.User) {
-			return ResultUser
+	if f.HasPatterns {
+		predicates = append(predicates, f.Patterns)
+	}
+	if f.UserMatchType != DontMatch {
+		user := UserPredicate{MatchType: f.UserMatchType}
+		if f.UserMatchType == MatchRegex {
+			if f.UserName != "" {
+				user.Regex = f.UserRegex
+			}
+			if f.NegativeUserName != "" {
+				user.NegativeRegex = f.NegativeUserRegex
+			}
+		} else {
+			user.Name = f.UserName
+			user.NegativeName = f.NegativeUserName
 		}
+		predicates = append(predicates, user)
+	}
+	for _, tag := range f.Tags {
+		predicates = append(predicates, tag)
+	}
+	if f.HasQuery {
+		predicates = append(predicates, f.Query)
+	}
+	predicates = append(predicates, f.Predicates...)
+	return And(predicates...)
+}
 
-		if f.NegativeUserName != "" && f.NegativeUserRegex.MatchString(msg.User) {
-			return ResultUser
-		}
-	case MatchExact:
-		if f.UserName != "" && f.UserName != msg.User {
-			return ResultUser
+// Filter performs all checks necessary to know if a given msg matches the Filter predicates. It builds the Predicate
+// on every call, use Predicate() once to check many messages.
+func (f Filter) Filter(msg *Message) FilterResult {
+	return f.Predicate().Filter(msg)
+}
+
+// MatchPositions returns the parts of the message text (the last argument) matched by MessageRegex and Patterns as
+// [start, end) byte offsets. The spans are sorted and overlapping ones are merged. Empty matches are left out, so a
+// filter without a message regex or patterns returns nothing.
+func (f Filter) MatchPositions(msg *Message) [][]int {
+	if len(msg.Args) == 0 {
+		return nil
+	}
+	text := msg.Args[len(msg.Args)-1]
+	var spans [][]int
+	if f.HasMessageRegex && f.MessageRegex != nil {
+		spans = append(spans, nonEmpty(f.MessageRegex.FindAllStringIndex(text, -1))...)
+	}
+	if f.HasPatterns && f.Patterns != nil {
+		spans = append(spans, f.Patterns.FindAll(text)...)
+	}
+	sortSpans(spans)
+	merged := make([][]int, 0, len(spans))
+	for _, span := range spans {
+		last := len(merged) - 1
+		if last >= 0 && span[0] <= merged[last][1] {
+			if span[1] > merged[last][1] {
+				merged[last][1] = span[1]
+			}
+			continue
 		}
+		merged = append(merged, []int{span[0], span[1]})
+	}
+	return merged
+}
 
-		if f.NegativeUserName != "" && f.NegativeUserName == msg.User {
-			return ResultUser
+func nonEmpty(spans [][]int) [][]int {
+	out := spans[:0]
+	for _, span := range spans {
+		if span[1] > span[0] {
+			out = append(out, span)
 		}
 	}
-	return ResultOk
+	return out
+}
+
+func sortSpans(spans [][]int) {
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i][0] == spans[j][0] {
+			return spans[i][1] < spans[j][1]
+		}
+		return spans[i][0] < spans[j][0]
+	})
 }
@@ -0,0 +1,174 @@
+package justgrep
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+type rawPredicate map[string]bool
+
+func (p rawPredicate) Filter(msg *Message) FilterResult {
+	if p[msg.Raw] {
+		return ResultOk
+	}
+	return ResultContent
+}
+
+func runStreamContext(predicate Predicate, count int, before int, after int, lines int) ([]StreamMessage, []int, bool) {
+	input := make(chan *Message)
+	output := make(chan StreamMessage)
+	cancelled := false
+	cancel := func() {
+		cancelled = true
+	}
+	go func() {
+		for i := 0; i < lines; i++ {
+			input <- &Message{Raw: strconv.Itoa(i)}
+		}
+		close(input)
+	}()
+	progress := &ProgressState{TotalResults: make([]int, ResultCount)}
+	done := make(chan []int)
+	go func() {
+		done <- StreamPredicateContext(predicate, count, before, after, context.CancelFunc(cancel), input, output, progress)
+	}()
+	var out []StreamMessage
+	for msg := range output {
+		out = append(out, msg)
+	}
+	results := <-done
+	// drain the rest of the input if the stream stopped early
+	for range input {
+	}
+	return out, results, cancelled
+}
+
+func formatStream(msgs []StreamMessage) string {
+	out := ""
+	for _, msg := range msgs {
+		if msg.GroupStart {
+			out += "|"
+		}
+		out += msg.Raw
+		if msg.IsContext {
+			out += "c"
+		}
+		out += " "
+	}
+	return out
+}
+
+func TestStreamPredicateContext(t *testing.T) {
+	out, results, _ := runStreamContext(rawPredicate{"3": true, "8": true}, 0, 1, 1, 10)
+	assert(t, "separate groups", formatStream(out), "|2c 3 4c |7c 8 9c ")
+	assert(t, "ok results", results[ResultOk], 2)
+
+	out, _, _ = runStreamContext(rawPredicate{"3": true, "5": true}, 0, 2, 1, 10)
+	assert(t, "merged groups", formatStream(out), "|2c 3 4c 5 6c 7c ")
+
+	out, _, _ = runStreamContext(rawPredicate{"0": true, "9": true}, 0, 3, 3, 10)
+	assert(t, "stream edges", formatStream(out), "|0 1c 2c 3c |6c 7c 8c 9 ")
+
+	out, results, cancelled := runStreamContext(rawPredicate{"3": true, "4": true}, 1, 2, 0, 10)
+	assert(t, "count reached", formatStream(out), "|3 4c 5c ")
+	assert(t, "count reached results", results[ResultMaxCountReached], 1)
+	assert(t, "count reached cancelled", cancelled, true)
+}
+
+// runContextFilter feeds every stream of raw lines to one ContextFilter, a "" line is sent as nil
+func runContextFilter(c *ContextFilter, streams ...[]string) ([]StreamMessage, []int) {
+	var out []StreamMessage
+	total := make([]int, ResultCount)
+	for _, lines := range streams {
+		if c.Done() {
+			break
+		}
+		input := make(chan *Message)
+		output := make(chan StreamMessage)
+		go func(lines []string) {
+			for _, line := range lines {
+				if line == "" {
+					input <- nil
+					continue
+				}
+				input <- &Message{Raw: line}
+			}
+			close(input)
+		}(lines)
+		progress := &ProgressState{TotalResults: total}
+		done := make(chan []int)
+		go func() {
+			done <- c.Stream(func() {}, input, output, progress)
+		}()
+		for msg := range output {
+			out = append(out, msg)
+		}
+		for result, count := range <-done {
+			total[result] += count
+		}
+		for range input {
+		}
+	}
+	return out, total
+}
+
+func TestContextFilter(t *testing.T) {
+	// the match is the oldest line of the first file
+	out, _ := runContextFilter(
+		NewContextFilter(rawPredicate{"a3": true}, 0, 2, 0),
+		[]string{"a1", "a2", "a3"},
+		[]string{"b1", "b2", "b3"},
+	)
+	assert(t, "before context in the next file", formatStream(out), "|a3 b1c b2c ")
+
+	// the match is the newest line of the second file
+	out, _ = runContextFilter(
+		NewContextFilter(rawPredicate{"b1": true}, 0, 0, 2),
+		[]string{"a1", "a2", "a3"},
+		[]string{"b1", "b2", "b3"},
+	)
+	assert(t, "after context in the previous file", formatStream(out), "|a2c a3c b1 ")
+
+	out, _ = runContextFilter(
+		NewContextFilter(rawPredicate{"a3": true, "b1": true}, 0, 1, 1),
+		[]string{"a1", "a2", "a3"},
+		[]string{"b1", "b2", "b3"},
+	)
+	assert(t, "no separator between files", formatStream(out), "|a2c a3 b1 b2c ")
+
+	// the count is reached, but the before context is still read from the next file
+	out, results := runContextFilter(
+		NewContextFilter(rawPredicate{"a3": true, "b2": true}, 1, 2, 0),
+		[]string{"a1", "a2", "a3"},
+		[]string{"b1", "b2", "b3"},
+		[]string{"c1"},
+	)
+	assert(t, "count reached at a file boundary", formatStream(out), "|a3 b1c b2c ")
+	assert(t, "count reached results", results[ResultOk], 1)
+
+	// context doesn't continue over the missing rest of an interrupted file
+	out, _ = runContextFilter(
+		NewContextFilter(rawPredicate{"a2": true, "b1": true}, 0, 1, 1),
+		[]string{"a1", "a2", "", "a3"},
+		[]string{"b1", "b2"},
+	)
+	assert(t, "interrupted file", formatStream(out), "|a1c a2 |b1 b2c ")
+}
+
+func TestFilter_MatchPositions(t *testing.T) {
+	msg, err := NewMessage("@tmi-sent-ts=1000 :a!a@a PRIVMSG #forsen :forsen forsenE Pepega")
+	assert(t, "err", err, nil)
+	filter := Filter{
+		HasMessageRegex: true,
+		MessageRegex:    regexp.MustCompile("forsen"),
+		HasPatterns:     true,
+		Patterns:        NewFixedPatternSet([]string{"senE P", "ega"}, false),
+	}
+	assert(t, "positions", fmt.Sprint(filter.MatchPositions(msg)), "[[0 6] [7 16] [18 21]]")
+
+	filter = Filter{HasMessageRegex: true, MessageRegex: regexp.MustCompile("")}
+	assert(t, "empty regex", len(filter.MatchPositions(msg)), 0)
+}
@@ -0,0 +1,21 @@
+package justgrep
+
+// NewUserHistoryAPI searches everything a user said in the given channels of a justlog instance, using the per-user
+// endpoints instead of downloading whole channel logs. Channels where the user has no logs are skipped after asking
+// for the list of available logs. Messages of all channels are merged newest first.
+//
+// Instances are named with RedactURL(url). Channels are addressed by id, so renamed channels keep working. If isId is set, user is a user id.
+func NewUserHistoryAPI(url string, channels ChannelList, user string, isId bool) *FederatedJustlogAPI {
+	api := &FederatedJustlogAPI{}
+	for _, channel := range channels {
+		api.APIs = append(api.APIs, &UserJustlogAPI{
+			Channel:     channel.UserID,
+			ChannelIsId: true,
+			User:        user,
+			IsId:        isId,
+			URL:         url,
+		})
+		api.Instances = append(api.Instances, RedactURL(url))
+	}
+	return api
+}
@@ -1,8 +1,8 @@
 package justgrep
 
 import (
-	"errors"
 	"fmt"
+	"io"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,50 +17,60 @@ type Message struct {
 	Action    string            `json:"action,omitempty"`
 	Tags      map[string]string `json:"tags,omitempty"`
 	Timestamp time.Time         `json:"timestamp"`
+
+	// Instances are the names of the justlog instances a message was found on, only set by FederatedJustlogAPI. It
+	// isn't part of the IRC message.
+	Instances []string `json:"-"`
+}
+
+// Serialize returns the message as a line of IRC ending with CRLF, see AppendTo.
+func (m Message) Serialize() string {
+	return string(m.AppendTo(make([]byte, 0, len(m.Raw)+2)))
 }
 
-func (m Message) Serialize() (output string) {
-	if m.Tags != nil && len(m.Tags) != 0 {
-		output += "@"
-		// this is all to sort tags alphabetically to produce constant output
-		keys := make([]string, len(m.Tags))
-		i := 0
+// AppendTo appends the message as a line of IRC ending with CRLF to buf and returns the extended buffer. It's built
+// from the structured fields, Raw isn't used. Tags are sorted alphabetically to produce constant output and their
+// values are escaped, the last argument is always written as a trailing argument.
+func (m Message) AppendTo(buf []byte) []byte {
+	if len(m.Tags) != 0 {
+		buf = append(buf, '@')
+		keys := make([]string, 0, len(m.Tags))
 		for k := range m.Tags {
-			keys[i] = k
-			i += 1
+			keys = append(keys, k)
 		}
 		sort.Strings(keys)
-
-		maxIdx := len(keys) - 1
 		for i, k := range keys {
-			v := m.Tags[k]
-			if i == maxIdx {
-				output += k + "=" + escapeValue(v)
-			} else {
-				output += k + "=" + escapeValue(v) + ";"
+			if i != 0 {
+				buf = append(buf, ';')
 			}
+			buf = append(buf, k...)
+			buf = append(buf, '=')
+			buf = appendEscapedValue(buf, m.Tags[k])
 		}
-		output += " "
+		buf = append(buf, ' ')
 	}
 	if m.Prefix != "" {
-		output += ":" + m.Prefix + " "
-	}
-	output += m.Action
-	if len(m.Args) != 0 {
-		output += " "
-		for i := 0; i < len(m.Args); i++ {
-			arg := m.Args[i]
-			if i == len(m.Args)-1 {
-				output += ":" + arg + "\r\n"
-				return
-			} else {
-				output += arg + " "
-			}
+		buf = append(buf, ':')
+		buf = append(buf, m.Prefix...)
+		buf = append(buf, ' ')
+	}
+	buf = append(buf, m.Action...)
+	for i, arg := range m.Args {
+		buf = append(buf, ' ')
+		if i == len(m.Args)-1 {
+			buf = append(buf, ':')
 		}
+		buf = append(buf, arg...)
 	}
-	output += "\r\n"
-	return // this should only be hit if there are no args
+	return append(buf, '\r', '\n')
+}
+
+// WriteTo writes the message as a line of IRC ending with CRLF to w, see AppendTo.
+func (m Message) WriteTo(w io.Writer) (n int64, err error) {
+	written, err := w.Write(m.AppendTo(make([]byte, 0, len(m.Raw)+2)))
+	return int64(written), err
 }
+
 func (m Message) String() string {
 	return fmt.Sprintf(
 		"Message{Prefix: %q, Action: %q, Args: %q, Timestamp: %s}",
@@ -71,89 +81,103 @@ func (m Message) String() string {
 	)
 }
 
+// ParseError is returned by NewMessage for invalid input.
+type ParseError struct {
+	// Kind describes the problem without any of the input, so errors can be grouped by it
+	Kind string
+	// Detail is the offending part of the input, if any
+	Detail string
+}
+
+func (e *ParseError) Error() string {
+	if e.Detail == "" {
+		return "parser error: " + e.Kind
+	}
+	return "parser error: " + e.Kind + ": " + e.Detail
+}
+
+func parseError(kind string, detail string) error {
+	return &ParseError{Kind: kind, Detail: detail}
+}
+
+// NewMessage parses a line of IRC following the IRCv3 message-tags spec: tags without a value are set to "", escapes
+// in values are resolved, repeated tags keep the last value and client-only tags keep their "+" (see IsClientTag).
+// Trailing CR and LF characters are ignored. Timestamp is set from the tmi-sent-ts or time tag.
 func NewMessage(text string) (*Message, error) {
 	if len(text) == 0 {
-		return nil, errors.New("parser error: empty input")
+		return nil, parseError("empty input", "")
 	}
 	output := &Message{Raw: text}
-	cpy := text
+	cpy := strings.TrimRight(text, "\r\n")
+	if cpy == "" {
+		return nil, parseError("empty input", "")
+	}
 	if cpy[0] == '@' {
-		cpy = cpy[1:]
 		// has tags
-		idx := strings.Index(cpy, " ")
+		idx := strings.IndexByte(cpy, ' ')
 		if idx == -1 {
-			return nil, errors.New("parser error: unable to find a space after tags, looks like input was trimmed")
-		}
-		tagsRaw := cpy[:idx]
-		output.Tags = make(map[string]string, 16)
-		for _, pair := range strings.Split(tagsRaw, ";") {
-			equalsIdx := strings.IndexRune(pair, '=')
-			if equalsIdx == -1 || len(pair) <= equalsIdx {
-				return nil, errors.New("parser error: invalid tag key value pair")
-			}
-			output.Tags[pair[:equalsIdx]] = unescapeValue(pair[equalsIdx+1:])
+			return nil, parseError("unable to find a space after tags, looks like input was trimmed", "")
 		}
-		cpy = cpy[idx+1:]
-		// skip doubled spaces
-		for cpy != "" && cpy[0] == ' ' {
-			cpy = cpy[1:]
+		tags, err := parseTags(cpy[1:idx])
+		if err != nil {
+			return nil, err
 		}
+		output.Tags = tags
+		// skip doubled spaces
+		cpy = strings.TrimLeft(cpy[idx+1:], " ")
 		if cpy == "" {
-			return nil, errors.New("parser error: expected more data after tags but found nothing")
+			return nil, parseError("expected more data after tags but found nothing", "")
 		}
 	}
 	if cpy[0] == ':' {
-		prefixIdx := strings.Index(cpy, " ")
+		prefixIdx := strings.IndexByte(cpy, ' ')
 		if prefixIdx == -1 {
-			return nil, errors.New("parser error: unable to find a space after the prefix, looks like input was trimmed")
+			return nil, parseError("unable to find a space after the prefix, looks like input was trimmed", "")
 		}
-		prefix := cpy[1:prefixIdx]
-		cpy = cpy[prefixIdx+1:]
-		output.Prefix = prefix
-		accountSep := strings.Index(prefix, "!")
-		if accountSep != -1 {
-			output.User = prefix[:accountSep]
+		output.Prefix = cpy[1:prefixIdx]
+		if strings.ContainsAny(output.Prefix, "!@") {
+			// a prefix without either is usually a server
+			output.User = ParseSource(output.Prefix).Nick
+		}
+		cpy = strings.TrimLeft(cpy[prefixIdx+1:], " ")
+		if cpy == "" {
+			return nil, parseError("expected a command after the prefix but found nothing", "")
 		}
 	}
-	actionIndex := strings.Index(cpy, " ")
+	actionIndex := strings.IndexByte(cpy, ' ')
 	if actionIndex == -1 {
 		output.Action = cpy
 	} else {
 		output.Action = cpy[:actionIndex]
 		cpy = cpy[actionIndex+1:]
 		for {
-			nextSpace := strings.Index(cpy, " ")
-			if nextSpace == -1 {
-				// has to be last arg!
-				if cpy[0] == ':' {
-					output.Args = append(output.Args, cpy[1:])
-				} else {
-					output.Args = append(output.Args, cpy)
-				}
+			// skip doubled spaces
+			cpy = strings.TrimLeft(cpy, " ")
+			if cpy == "" {
 				break
 			}
-			currentArg := cpy[:nextSpace]
-			if currentArg == "" {
-				// double space, skip!
-				cpy = cpy[1:] // advance one char
-				continue
-			} else if currentArg[0] == ':' {
-				// last argument.
+			if cpy[0] == ':' {
+				// the trailing argument, it can contain spaces or be empty
 				output.Args = append(output.Args, cpy[1:])
 				break
 			}
-			output.Args = append(output.Args, currentArg)
-			cpy = cpy[nextSpace+1:]
-			if cpy == "" {
+			nextSpace := strings.IndexByte(cpy, ' ')
+			if nextSpace == -1 {
+				output.Args = append(output.Args, cpy)
 				break
 			}
+			output.Args = append(output.Args, cpy[:nextSpace])
+			cpy = cpy[nextSpace+1:]
 		}
 	}
+	if output.Action == "" {
+		return nil, parseError("missing command", "")
+	}
 	ts, hasTs := output.Tags["tmi-sent-ts"]
 	if hasTs {
 		parsedInt, err := strconv.ParseInt(ts, 10, 64)
 		if err != nil {
-			return nil, errors.New(fmt.Sprintf("parser error: unable to parse time (@tmi-sent-ts): %q: %s", ts, err))
+			return nil, parseError("unable to parse time (@tmi-sent-ts)", fmt.Sprintf("%q: %s", ts, err))
 		}
 		output.Timestamp = time.Unix(parsedInt/1000, parsedInt%1000*1000000)
 	} else {
@@ -161,7 +185,7 @@ func NewMessage(text string) (*Message, error) {
 		if hasTs {
 			stamp, err := time.Parse(time.RFC3339, ts)
 			if err != nil {
-				return nil, errors.New(fmt.Sprintf("parser error: unable to parse time (@time): %q: %s", ts, err))
+				return nil, parseError("unable to parse time (@time)", fmt.Sprintf("%q: %s", ts, err))
 			}
 			output.Timestamp = stamp
 		}
@@ -169,58 +193,119 @@ func NewMessage(text string) (*Message, error) {
 	return output, nil
 }
 
+// parseTags parses the tags part of a message, without the @
+func parseTags(raw string) (map[string]string, error) {
+	tags := make(map[string]string, 16)
+	for _, pair := range strings.Split(raw, ";") {
+		if pair == "" {
+			continue
+		}
+		key, value := pair, ""
+		if equalsIdx := strings.IndexByte(pair, '='); equalsIdx != -1 {
+			key, value = pair[:equalsIdx], unescapeValue(pair[equalsIdx+1:])
+		}
+		if key == "" || key == "+" {
+			return nil, parseError("invalid tag key value pair", "")
+		}
+		tags[key] = value
+	}
+	return tags, nil
+}
+
+// IsClientTag reports whether key is a client-only tag, which are prefixed with "+", like "+draft/reply".
+func IsClientTag(key string) bool {
+	return strings.HasPrefix(key, "+")
+}
+
+// Source is a prefix split into its parts, nick!user@host. User and Host are optional, a prefix which is only a
+// server name, like tmi.twitch.tv, is returned as the Nick since the two can't be told apart.
+type Source struct {
+	Nick string
+	User string
+	Host string
+}
+
+// ParseSource splits a prefix into its parts.
+func ParseSource(prefix string) Source {
+	source := Source{Nick: prefix}
+	if idx := strings.IndexByte(source.Nick, '@'); idx != -1 {
+		source.Host = source.Nick[idx+1:]
+		source.Nick = source.Nick[:idx]
+	}
+	if idx := strings.IndexByte(source.Nick, '!'); idx != -1 {
+		source.User = source.Nick[idx+1:]
+		source.Nick = source.Nick[:idx]
+	}
+	return source
+}
+
+// String joins the parts back into a prefix.
+func (s Source) String() string {
+	prefix := s.Nick
+	if s.User != "" {
+		prefix += "!" + s.User
+	}
+	if s.Host != "" {
+		prefix += "@" + s.Host
+	}
+	return prefix
+}
+
+// Source returns the parts of the message's prefix.
+func (m Message) Source() Source {
+	return ParseSource(m.Prefix)
+}
+
+// unescapeValue resolves the escapes of a tag value. It works on bytes so invalid UTF-8 is kept as it is.
 func unescapeValue(s string) string {
-	nextEscaped := false
-	unescaper := func(r rune) rune {
-		if nextEscaped {
-			nextEscaped = false
-			switch r {
-			case ':':
-				return ';'
-			case 'r':
-				return '\r'
-			case 'n':
-				return '\n'
-			case 's':
-				return ' '
-			default:
-				return r
-			}
-		} else if r == '\\' {
-			nextEscaped = true
-			return -1
-		} else {
-			return r
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			out = append(out, c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			// a trailing backslash is dropped
+			break
+		}
+		switch s[i] {
+		case ':':
+			out = append(out, ';')
+		case 'r':
+			out = append(out, '\r')
+		case 'n':
+			out = append(out, '\n')
+		case 's':
+			out = append(out, ' ')
+		default:
+			out = append(out, s[i])
 		}
 	}
-	return strings.Map(unescaper, s)
+	return string(out)
 }
 
-func escapeValue(s string) string {
-	out := make([]rune, 1024)
-	usedCount := 0
-	for _, chr := range s {
-		switch chr {
+// appendEscapedValue appends a tag value escaped according to the IRCv3 message-tags spec to buf
+func appendEscapedValue(buf []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			buf = append(buf, '\\', '\\')
 		case ';':
-			out[usedCount] = '\\'
-			out[usedCount+1] = ':'
-			usedCount += 2
+			buf = append(buf, '\\', ':')
 		case '\r':
-			out[usedCount] = '\\'
-			out[usedCount+1] = 'r'
-			usedCount += 2
+			buf = append(buf, '\\', 'r')
 		case '\n':
-			out[usedCount] = '\\'
-			out[usedCount+1] = 'n'
-			usedCount += 2
+			buf = append(buf, '\\', 'n')
 		case ' ':
-			out[usedCount] = '\\'
-			out[usedCount+1] = 's'
-			usedCount += 2
+			buf = append(buf, '\\', 's')
 		default:
-			out[usedCount] = chr
-			usedCount += 1
+			buf = append(buf, c)
 		}
 	}
-	return string(out[:usedCount])
+	return buf
 }
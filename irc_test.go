@@ -2,8 +2,12 @@ package justgrep
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -183,3 +187,282 @@ func BenchmarkMessage_Serialize(b *testing.B) {
 		_ = m.Serialize()
 	}
 }
+
+func TestNewMessage_ParseError(t *testing.T) {
+	_, err := NewMessage("@tmi-sent-ts=abc :a!a@a PRIVMSG #a :hi")
+	var parseErr *ParseError
+	assert(t, "is ParseError", errors.As(err, &parseErr), true)
+	assert(t, "kind", parseErr.Kind, "unable to parse time (@tmi-sent-ts)")
+	assert(
+		t,
+		"message",
+		err.Error(),
+		`parser error: unable to parse time (@tmi-sent-ts): "abc": strconv.ParseInt: parsing "abc": invalid syntax`,
+	)
+
+	_, err = NewMessage("")
+	assert(t, "no detail", err.Error(), "parser error: empty input")
+}
+
+// cases from the ircdocs parser-tests msg-split.yaml
+func TestNewMessage_Split(t *testing.T) {
+	tests := []struct {
+		input  string
+		tags   map[string]string
+		prefix string
+		action string
+		args   []string
+	}{
+		{"foo bar baz asdf", nil, "", "foo", []string{"bar", "baz", "asdf"}},
+		{":coolguy foo bar baz asdf", nil, "coolguy", "foo", []string{"bar", "baz", "asdf"}},
+		{"foo bar baz :asdf quux", nil, "", "foo", []string{"bar", "baz", "asdf quux"}},
+		{"foo bar baz :", nil, "", "foo", []string{"bar", "baz", ""}},
+		{"foo bar baz ::asdf", nil, "", "foo", []string{"bar", "baz", ":asdf"}},
+		{":coolguy foo bar baz :asdf quux", nil, "coolguy", "foo", []string{"bar", "baz", "asdf quux"}},
+		{":coolguy foo bar baz :  asdf quux ", nil, "coolguy", "foo", []string{"bar", "baz", "  asdf quux "}},
+		{":coolguy PRIVMSG bar :lol :) ", nil, "coolguy", "PRIVMSG", []string{"bar", "lol :) "}},
+		{":coolguy foo bar baz :", nil, "coolguy", "foo", []string{"bar", "baz", ""}},
+		{":coolguy foo bar baz :  ", nil, "coolguy", "foo", []string{"bar", "baz", "  "}},
+		{
+			"@a=b;c=32;k;rt=ql7 foo",
+			map[string]string{"a": "b", "c": "32", "k": "", "rt": "ql7"},
+			"",
+			"foo",
+			nil,
+		},
+		{
+			`@a=b\\and\nk;c=72\s45;d=gh\:764 foo`,
+			map[string]string{"a": "b\\and\nk", "c": "72 45", "d": "gh;764"},
+			"",
+			"foo",
+			nil,
+		},
+		{"@c;h=;a=b :quux ab cd", map[string]string{"c": "", "h": "", "a": "b"}, "quux", "ab", []string{"cd"}},
+		{":src JOIN #chan", nil, "src", "JOIN", []string{"#chan"}},
+		{":src JOIN :#chan", nil, "src", "JOIN", []string{"#chan"}},
+		{":src AWAY", nil, "src", "AWAY", nil},
+		{":src AWAY ", nil, "src", "AWAY", nil},
+		{":cool\tguy foo bar baz", nil, "cool\tguy", "foo", []string{"bar", "baz"}},
+		{
+			":coolguy!ag@net\x035w\x03ork.admin PRIVMSG foo :bar baz",
+			nil,
+			"coolguy!ag@net\x035w\x03ork.admin",
+			"PRIVMSG",
+			[]string{"foo", "bar baz"},
+		},
+		{
+			"@tag1=value1;tag2;vendor1/tag3=value2;vendor2/tag4= COMMAND param1 param2 :param3 param3",
+			map[string]string{"tag1": "value1", "tag2": "", "vendor1/tag3": "value2", "vendor2/tag4": ""},
+			"",
+			"COMMAND",
+			[]string{"param1", "param2", "param3 param3"},
+		},
+		{
+			`@foo=\\\\\:\\s\s\r\n COMMAND`,
+			map[string]string{"foo": "\\\\;\\s \r\n"},
+			"",
+			"COMMAND",
+			nil,
+		},
+		{
+			":gravel.mozilla.org 432  #momo :Erroneous Nickname: Illegal characters",
+			nil,
+			"gravel.mozilla.org",
+			"432",
+			[]string{"#momo", "Erroneous Nickname: Illegal characters"},
+		},
+		{":gravel.mozilla.org MODE #tckk +n ", nil, "gravel.mozilla.org", "MODE", []string{"#tckk", "+n"}},
+		{
+			":services.esper.net MODE #foo-bar +o foobar  ",
+			nil,
+			"services.esper.net",
+			"MODE",
+			[]string{"#foo-bar", "+o", "foobar"},
+		},
+		{`@tag1=value\\ntest COMMAND`, map[string]string{"tag1": `value\ntest`}, "", "COMMAND", nil},
+		{`@tag1=value\1 COMMAND`, map[string]string{"tag1": "value1"}, "", "COMMAND", nil},
+		{`@tag1=value1\ COMMAND`, map[string]string{"tag1": "value1"}, "", "COMMAND", nil},
+		{
+			"@tag1=1;tag2=3;tag3=4;tag1=5 COMMAND",
+			map[string]string{"tag1": "5", "tag2": "3", "tag3": "4"},
+			"",
+			"COMMAND",
+			nil,
+		},
+		{
+			"@tag1=1;tag2=3;tag3=4;tag1=5;vendor/tag2=8 COMMAND",
+			map[string]string{"tag1": "5", "tag2": "3", "tag3": "4", "vendor/tag2": "8"},
+			"",
+			"COMMAND",
+			nil,
+		},
+		{":SomeOp MODE #channel :+i", nil, "SomeOp", "MODE", []string{"#channel", "+i"}},
+		{
+			":SomeOp MODE #channel +oo SomeUser :AnotherUser",
+			nil,
+			"SomeOp",
+			"MODE",
+			[]string{"#channel", "+oo", "SomeUser", "AnotherUser"},
+		},
+		{
+			"@+draft/reply=abc;+example.com/x :a!a@a TAGMSG #a",
+			map[string]string{"+draft/reply": "abc", "+example.com/x": ""},
+			"a!a@a",
+			"TAGMSG",
+			[]string{"#a"},
+		},
+		{":a!a@a PRIVMSG #a :hi\r\n", nil, "a!a@a", "PRIVMSG", []string{"#a", "hi"}},
+	}
+	for _, test := range tests {
+		m, err := NewMessage(test.input)
+		assert(t, test.input+" error", err, nil)
+		if err != nil {
+			continue
+		}
+		assert(t, test.input+" prefix", m.Prefix, test.prefix)
+		assert(t, test.input+" action", m.Action, test.action)
+		assertStrSlc(t, test.input+" args", m.Args, test.args)
+		assertStrMap(t, test.input+" tags", m.Tags, test.tags)
+	}
+
+	for _, input := range []string{"", "\r\n", "@a=b", "@a=b ", ":prefix", ":prefix  ", "@=a foo", "@+ foo", " foo"} {
+		_, err := NewMessage(input)
+		assert(t, fmt.Sprintf("%q fails", input), err != nil, true)
+	}
+}
+
+// cases from the ircdocs parser-tests userhost-split.yaml
+func TestParseSource(t *testing.T) {
+	tests := map[string]Source{
+		"coolguy":                           {Nick: "coolguy"},
+		"coolguy!ag@127.0.0.1":              {Nick: "coolguy", User: "ag", Host: "127.0.0.1"},
+		"coolguy!~ag@localhost":             {Nick: "coolguy", User: "~ag", Host: "localhost"},
+		"coolguy@127.0.0.1":                 {Nick: "coolguy", Host: "127.0.0.1"},
+		"coolguy!ag":                        {Nick: "coolguy", User: "ag"},
+		"coolguy!ag@net\x035w\x03ork.admin": {Nick: "coolguy", User: "ag", Host: "net\x035w\x03ork.admin"},
+		"coolguy!~ag@n\x02et\x0305w\x0fork.admin": {
+			Nick: "coolguy",
+			User: "~ag",
+			Host: "n\x02et\x0305w\x0fork.admin",
+		},
+	}
+	for prefix, expected := range tests {
+		assert(t, prefix, ParseSource(prefix), expected)
+	}
+
+	m, err := NewMessage(":coolguy@127.0.0.1 PRIVMSG #a :hi")
+	assert(t, "error", err, nil)
+	assert(t, "user without !", m.User, "coolguy")
+	m, err = NewMessage(":tmi.twitch.tv CLEARCHAT #a")
+	assert(t, "error", err, nil)
+	assert(t, "server", m.User, "")
+	assert(t, "client tag", IsClientTag("+draft/reply"), true)
+	assert(t, "server tag", IsClientTag("msg-id"), false)
+	assert(t, "server source", m.Source(), Source{Nick: "tmi.twitch.tv"})
+}
+
+func TestEscapeValue(t *testing.T) {
+	tests := []struct {
+		unescaped string
+		escaped   string
+	}{
+		{"", ""},
+		{"abcdef", "abcdef"},
+		{`\`, `\\`},
+		{";", `\:`},
+		{" ", `\s`},
+		{"\r", `\r`},
+		{"\n", `\n`},
+		{`a\b;c d`, `a\\b\:c\sd`},
+		{`\\;\s` + " \r\n", `\\\\\:\\s\s\r\n`},
+		{"ünïcödé ✨", `ünïcödé\s✨`},
+	}
+	for _, test := range tests {
+		assert(t, "escape "+test.escaped, string(appendEscapedValue(nil, test.unescaped)), test.escaped)
+		assert(t, "unescape "+test.escaped, unescapeValue(test.escaped), test.unescaped)
+	}
+	// invalid escapes are dropped
+	assert(t, "unknown escape", unescapeValue(`\b`), "b")
+	assert(t, "trailing backslash", unescapeValue(`a\`), "a")
+
+	long := strings.Repeat("a; b\\", 1000)
+	m := Message{Action: "TEST", Tags: map[string]string{"long": long}}
+	parsed, err := NewMessage(m.Serialize())
+	assert(t, "error", err, nil)
+	assert(t, "long value", parsed.Tags["long"], long)
+}
+
+func TestMessage_WriteTo(t *testing.T) {
+	m := getTestMessage()
+	out := &bytes.Buffer{}
+	n, err := m.WriteTo(out)
+	assert(t, "error", err, nil)
+	assert(t, "written", out.String(), m.Raw+"\r\n")
+	assert(t, "length", n, int64(len(m.Raw)+2))
+
+	assert(t, "append", string(m.AppendTo([]byte("> "))), "> "+m.Raw+"\r\n")
+	assert(t, "no tags or args", Message{Action: "PING"}.Serialize(), "PING\r\n")
+	assert(
+		t,
+		"empty trailing argument",
+		Message{Prefix: "a", Action: "PRIVMSG", Args: []string{"#a", ""}}.Serialize(),
+		":a PRIVMSG #a :\r\n",
+	)
+}
+
+// randomMessage generates a message which can be represented as IRC
+func randomMessage(r *rand.Rand) *Message {
+	word := func(alphabet string, min int) string {
+		out := make([]byte, min+r.Intn(8))
+		for i := range out {
+			out[i] = alphabet[r.Intn(len(alphabet))]
+		}
+		return string(out)
+	}
+	const letters = "abcdefghijklmnopqrstuvwxyzABC0123456789-"
+	const anything = letters + ` ;:\=@!#+/` + "\r\n\x01ü"
+	m := &Message{Action: word(letters, 1)}
+	if r.Intn(2) == 0 {
+		m.User = word(letters, 1)
+		m.Prefix = m.User + "!" + m.User + "@" + word(letters, 1) + ".tmi.twitch.tv"
+	}
+	tagCount := r.Intn(5)
+	if tagCount != 0 {
+		m.Tags = make(map[string]string)
+		for i := 0; i < tagCount; i++ {
+			key := word(letters, 1)
+			if r.Intn(4) == 0 {
+				key = "+vendor.example/" + key
+			}
+			m.Tags[key] = word(anything, 0)
+		}
+	}
+	for i := r.Intn(4); i > 0; i-- {
+		m.Args = append(m.Args, word(letters+"#:", 1))
+	}
+	if r.Intn(2) == 0 {
+		// CR and LF end the line, so they can't be in arguments
+		m.Args = append(m.Args, strings.NewReplacer("\r", "", "\n", "").Replace(word(anything, 0)))
+	}
+	for i := 0; i < len(m.Args)-1; i++ {
+		// only the trailing argument can start with a colon
+		m.Args[i] = "#" + m.Args[i]
+	}
+	return m
+}
+
+func TestMessage_SerializeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		m := randomMessage(r)
+		serialized := m.Serialize()
+		parsed, err := NewMessage(serialized)
+		if err != nil {
+			t.Fatalf("%q doesn't parse: %s", serialized, err)
+		}
+		if !parsed.Equal(m) {
+			t.Fatalf("%q parsed into %#v, expected %#v", serialized, parsed, m)
+		}
+		assert(t, "serialized again", parsed.Serialize(), serialized)
+	}
+}
@@ -2,6 +2,7 @@ package justgrep
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -41,47 +42,195 @@ type ProgressState struct {
 	BeginTime time.Time `json:"begin_time"`
 }
 
-func fetch(ctx context.Context, url string, client *http.Client, output chan *Message, progress *ProgressState) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return err
+// fetch downloads a log file and puts its messages onto output. If cacheable is set and LogFileCache is enabled, the
+// file is read from or saved to the cache. Failed requests and interrupted downloads are retried according to
+// FetchRetryPolicy, taking retries from the RetryBudget of ctx if it has one.
+func fetch(
+	ctx context.Context,
+	url string,
+	client *http.Client,
+	output chan *Message,
+	progress *ProgressState,
+	cacheable bool,
+) error {
+	if cacheable && LogFileCache != nil {
+		if cached := LogFileCache.Open(url); cached != nil {
+			go readMessages(ctx, url, cached, output, progress, nil, nil)
+			return nil
+		}
 	}
-	req.Header.Set("User-Agent", UserAgent)
-	resp, err := client.Do(req)
+	policy := FetchRetryPolicy
+	budget := retryBudget(ctx, policy)
+	body, err := openURL(ctx, url, client, policy, budget)
 	if err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		defer resp.Body.Close()
-		scanner := bufio.NewScanner(resp.Body)
-		if scanner.Scan() {
-			return errors.New(fmt.Sprintf("justlog instance responded with %d: %q", resp.StatusCode, scanner.Text()))
+
+	var cacheWriter *CacheWriter
+	if cacheable && LogFileCache != nil {
+		cacheWriter, err = LogFileCache.Create(url)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Unable to cache %s: %s\n", url, err)
+			cacheWriter = nil
+		}
+	}
+	reopen := func(err error) (io.ReadCloser, error) {
+		for {
+			attempt, ok := budget.Take()
+			if !ok {
+				return nil, err
+			}
+			if !policy.Wait(ctx, url, attempt, err) {
+				return nil, ctx.Err()
+			}
+			var body io.ReadCloser
+			body, err = requestURL(ctx, url, client)
+			if err == nil {
+				return body, nil
+			}
+			if ctx.Err() != nil || !isRetryable(err) {
+				return nil, err
+			}
 		}
-		return errors.New(fmt.Sprintf("justlog instance responded with unexpected %d status code", resp.StatusCode))
 	}
+	go readMessages(ctx, url, body, output, progress, cacheWriter, reopen)
+	return nil
+}
 
-	go func() {
-		defer resp.Body.Close()
+// errFileChanged is returned when a download can't be resumed because the last received line is gone.
+var errFileChanged = errors.New("unable to resume download, the log file has changed")
 
-		scanner := bufio.NewScanner(resp.Body)
+// readMessages parses body line by line and closes output when done. The raw data is also written to cacheWriter
+// which is only committed if the whole file was read successfully.
+//
+// If reading body fails and reopen is set, it is used to get a new body. Lines up to and including the last one already
+// sent are skipped, so resuming doesn't produce duplicates. Lines added to the top of a reversed file in the meantime
+// are skipped as well, they were not part of the original download either.
+func readMessages(
+	ctx context.Context,
+	url string,
+	body io.ReadCloser,
+	output chan *Message,
+	progress *ProgressState,
+	cacheWriter *CacheWriter,
+	reopen func(err error) (io.ReadCloser, error),
+) {
+	complete := true
+	lastLine := ""
+	resuming := false
+	// nobody might be reading anymore after cancelling
+	send := func(msg *Message) bool {
+		select {
+		case output <- msg:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	for {
+		reader := &errorReader{Reader: body}
+		if cacheWriter != nil {
+			reader.Reader = io.TeeReader(body, cacheWriter)
+		}
+		scanner := bufio.NewScanner(reader)
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			// an interrupted download ends in the middle of a line, which would be a corrupt message
+			if atEOF && reader.err != io.EOF && bytes.IndexByte(data, '\n') == -1 {
+				return 0, nil, nil
+			}
+			return bufio.ScanLines(data, atEOF)
+		})
 
+		stopped := false
 		for scanner.Scan() {
-			msg, err := NewMessage(scanner.Text())
+			line := scanner.Text()
+			if resuming {
+				resuming = line != lastLine
+				continue
+			}
+			msg, err := NewMessage(line)
 			progress.CountLines += 1
 			if err != nil {
-				output <- nil
+				send(nil)
 				_, _ = fmt.Fprintf(os.Stderr, "Error while fetching from %s: %s\n", url, err)
+				stopped = true
 				break
 			}
 			progress.CountBytes += len(msg.Raw)
-			output <- msg
+			if !send(msg) {
+				stopped = true
+				break
+			}
+			lastLine = line
 			if ctx.Err() != nil {
+				stopped = true
 				break
 			}
 		}
-		close(output)
-	}()
-	return nil
+		_ = body.Close()
+		if stopped {
+			complete = false
+			break
+		}
+		err := scanner.Err()
+		if err == nil && resuming {
+			complete = false
+			FetchRetryPolicy.failed(url, errFileChanged)
+			send(nil)
+			break
+		}
+		if err == nil {
+			break
+		}
+		complete = false
+		if ctx.Err() != nil {
+			break
+		}
+		if reopen == nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error while fetching from %s: %s\n", url, err)
+			send(nil)
+			break
+		}
+		// the cache would get a mix of both downloads
+		if cacheWriter != nil {
+			cacheWriter.Abort()
+			cacheWriter = nil
+		}
+		body, err = reopen(err)
+		if err != nil {
+			if ctx.Err() == nil {
+				FetchRetryPolicy.failed(url, err)
+				send(nil)
+			}
+			break
+		}
+		resuming = lastLine != ""
+	}
+	if cacheWriter != nil {
+		if complete {
+			err := cacheWriter.Commit()
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Unable to cache %s: %s\n", url, err)
+			}
+		} else {
+			cacheWriter.Abort()
+		}
+	}
+	close(output)
+}
+
+// errorReader remembers the error which ended reading
+type errorReader struct {
+	io.Reader
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
 }
 
 func FetchForDate(
@@ -92,8 +241,23 @@ func FetchForDate(
 	progress *ProgressState,
 	client *http.Client,
 ) (time.Time, error) {
+	if fetcher, ok := api.(MessageFetcher); ok {
+		err := fetcher.FetchMessages(ctx, date, output, progress, client)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return api.NextLogFile(date), nil
+	}
 	u := api.MakeURL(date)
-	err := fetch(ctx, u, client, output, progress)
+	if opener, ok := api.(LogFileOpener); ok {
+		body, err := opener.OpenLogFile(ctx, date)
+		if err != nil {
+			return time.Time{}, err
+		}
+		go readMessages(ctx, u, body, output, progress, nil, nil)
+		return api.NextLogFile(date), nil
+	}
+	err := fetch(ctx, u, client, output, progress, isFinished(api, date, time.Now()))
 	if err != nil {
 		return time.Time{}, err
 	} else {
@@ -120,6 +284,24 @@ type UserJustlogAPI struct {
 	User    string
 	URL     string
 	IsId    bool
+
+	// ChannelIsId makes Channel a channel id
+	ChannelIsId bool
+}
+
+func channelPath(channel string, isId bool) string {
+	if isId {
+		return "channelid/" + channel
+	}
+	return "channel/" + channel
+}
+
+func addChannelQuery(q url.Values, channel string, isId bool) {
+	if isId {
+		q.Add("channelid", channel)
+	} else {
+		q.Add("channel", channel)
+	}
 }
 
 func (api UserJustlogAPI) NextLogFile(currentDate time.Time) time.Time {
@@ -129,18 +311,18 @@ func (api UserJustlogAPI) NextLogFile(currentDate time.Time) time.Time {
 func (api UserJustlogAPI) MakeURL(date time.Time) string {
 	if api.IsId {
 		return fmt.Sprintf(
-			"%s/channel/%s/userid/%s/%d/%d?raw&reverse",
+			"%s/%s/userid/%s/%d/%d?raw&reverse",
 			api.URL,
-			api.Channel,
+			channelPath(api.Channel, api.ChannelIsId),
 			api.User,
 			date.Year(),
 			date.Month(),
 		)
 	}
 	return fmt.Sprintf(
-		"%s/channel/%s/user/%s/%d/%d?raw&reverse",
+		"%s/%s/user/%s/%d/%d?raw&reverse",
 		api.URL,
-		api.Channel,
+		channelPath(api.Channel, api.ChannelIsId),
 		api.User,
 		date.Year(),
 		date.Month(),
@@ -155,6 +337,9 @@ type ChannelJustlogAPI struct {
 	JustlogAPI
 	Channel string
 	URL     string
+
+	// IsId makes Channel a channel id, which keeps working after the channel is renamed
+	IsId bool
 }
 
 func (api ChannelJustlogAPI) NextLogFile(currentDate time.Time) time.Time {
@@ -163,23 +348,48 @@ func (api ChannelJustlogAPI) NextLogFile(currentDate time.Time) time.Time {
 
 func (api ChannelJustlogAPI) MakeURL(date time.Time) string {
 	return fmt.Sprintf(
-		"%s/channel/%s/%d/%d/%d?raw&reverse",
+		"%s/%s/%d/%d/%d?raw&reverse",
 		api.URL,
-		api.Channel,
+		channelPath(api.Channel, api.IsId),
 		date.Year(),
 		date.Month(),
 		date.Day(),
 	)
 }
 
+// JustlogChannel is a channel logged by a justlog instance
+type JustlogChannel struct {
+	UserID string `json:"userID"`
+	Name   string `json:"name"`
+}
+
+type ChannelList []JustlogChannel
+
+// ByName finds a channel by its current name.
+func (l ChannelList) ByName(name string) (JustlogChannel, bool) {
+	for _, channel := range l {
+		if channel.Name == name {
+			return channel, true
+		}
+	}
+	return JustlogChannel{}, false
+}
+
+// ByID finds a channel by its user id.
+func (l ChannelList) ByID(id string) (JustlogChannel, bool) {
+	for _, channel := range l {
+		if channel.UserID == id {
+			return channel, true
+		}
+	}
+	return JustlogChannel{}, false
+}
+
 type channelsResp struct {
-	Channels []struct {
-		UserID string `json:"userID"`
-		Name   string `json:"name"`
-	} `json:"channels"`
+	Channels ChannelList `json:"channels"`
 }
 
-func GetChannelsFromJustLog(ctx context.Context, client *http.Client, url string) ([]string, error) {
+func GetChannelsFromJustLog(ctx context.Context, client *http.Client, url string) (ChannelList, error) {
 	req, err := http.NewRequestWithContext(ctx, "GET", url+"/channels", nil)
 	if err != nil {
 		return nil, err
@@ -195,11 +405,7 @@ func GetChannelsFromJustLog(ctx context.Context, client *http.Client, url string
 	if err != nil {
 		return nil, err
 	}
-	channels := make([]string, 0, 32)
-	for _, channel := range output.Channels {
-		channels = append(channels, channel.Name)
-	}
-	return channels, nil
+	return output.Channels, nil
 }
 
 // AvailableLogEntry describes an element from justlog's /list api array
@@ -351,7 +557,7 @@ func (api ChannelJustlogAPI) GetAvailableLogs(ctx context.Context, client *http.
 	}
 	list, _ := u.Parse("/list")
 	q := list.Query()
-	q.Add("channel", api.Channel)
+	addChannelQuery(q, api.Channel, api.IsId)
 
 	list.RawQuery = q.Encode()
 
@@ -386,7 +592,7 @@ func (api UserJustlogAPI) GetAvailableLogs(ctx context.Context, client *http.Cli
 	}
 	list, _ := u.Parse("/list")
 	q := list.Query()
-	q.Add("channel", api.Channel)
+	addChannelQuery(q, api.Channel, api.ChannelIsId)
 	if api.IsId {
 		q.Add("userid", api.User)
 	} else {
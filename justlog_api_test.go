@@ -1,10 +1,57 @@
 package justgrep
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
 
+func TestMakeURL(t *testing.T) {
+	date := time.Date(2022, 3, 4, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		api      JustlogAPI
+		expected string
+	}{
+		{ChannelJustlogAPI{URL: "https://l", Channel: "forsen"}, "https://l/channel/forsen/2022/3/4?raw&reverse"},
+		{
+			ChannelJustlogAPI{URL: "https://l", Channel: "22484632", IsId: true},
+			"https://l/channelid/22484632/2022/3/4?raw&reverse",
+		},
+		{
+			UserJustlogAPI{URL: "https://l", Channel: "forsen", User: "a"},
+			"https://l/channel/forsen/user/a/2022/3?raw&reverse",
+		},
+		{
+			UserJustlogAPI{URL: "https://l", Channel: "22484632", ChannelIsId: true, User: "1", IsId: true},
+			"https://l/channelid/22484632/userid/1/2022/3?raw&reverse",
+		},
+	}
+	for _, test := range tests {
+		assert(t, fmt.Sprintf("%#v", test.api), test.api.MakeURL(date), test.expected)
+	}
+}
+
+func TestGetChannelsFromJustLog(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"channels":[{"userID":"11148817","name":"pajlada"},{"userID":"22484632","name":"forsen"}]}`)
+	}))
+	defer server.Close()
+	channels, err := GetChannelsFromJustLog(context.Background(), server.Client(), server.URL)
+	assert(t, "err", err, nil)
+	assert(t, "channel count", len(channels), 2)
+	channel, ok := channels.ByName("forsen")
+	assert(t, "found by name", ok, true)
+	assert(t, "id", channel.UserID, "22484632")
+	channel, ok = channels.ByID("11148817")
+	assert(t, "found by id", ok, true)
+	assert(t, "name", channel.Name, "pajlada")
+	_, ok = channels.ByID("1")
+	assert(t, "unknown id", ok, false)
+}
+
 func TestLogsList_Snip(t *testing.T) {
 	l := LogsList{
 		AvailableLogEntry{
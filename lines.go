@@ -0,0 +1,66 @@
+package justgrep
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// DefaultMaxLineLength is the MaxLength of readers made by NewLineReader, much more than Twitch's messages ever need.
+const DefaultMaxLineLength = 1024 * 1024
+
+// ErrLineTooLong is returned by LineReader.Next for lines longer than MaxLength.
+var ErrLineTooLong = errors.New("line too long")
+
+// LineReader splits a stream of IRC messages into lines. Unlike bufio.Scanner it keeps going after a line that is too
+// long, so the caller can decide what to do with it.
+type LineReader struct {
+	// MaxLength is the longest line in bytes, without the line ending
+	MaxLength int
+
+	reader *bufio.Reader
+}
+
+func NewLineReader(r io.Reader) *LineReader {
+	return &LineReader{MaxLength: DefaultMaxLineLength, reader: bufio.NewReader(r)}
+}
+
+// Next returns the next line without the LF or CRLF ending, or io.EOF at the end of the stream. For lines longer than
+// MaxLength, the first MaxLength bytes are returned with ErrLineTooLong and the rest is skipped.
+func (r *LineReader) Next() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			if len(trimLineEnding(line)) > r.MaxLength {
+				line = line[:r.MaxLength]
+				tooLong = true
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return string(line), ErrLineTooLong
+	}
+	return string(trimLineEnding(line)), nil
+}
+
+func trimLineEnding(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
@@ -0,0 +1,42 @@
+package justgrep
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineReader(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+	r := NewLineReader(strings.NewReader("a\r\n" + long + "\nb\n\n" + strings.Repeat("y", 20) + "\nc"))
+	r.MaxLength = 4096
+
+	line, err := r.Next()
+	assert(t, "line", line, "a")
+	assert(t, "err", err, nil)
+	line, err = r.Next()
+	assert(t, "too long line", line, long[:4096])
+	assert(t, "too long err", err, ErrLineTooLong)
+	// the rest of the long line isn't returned
+	line, err = r.Next()
+	assert(t, "line after long one", line, "b")
+	assert(t, "err", err, nil)
+	line, err = r.Next()
+	assert(t, "empty line", line, "")
+	assert(t, "err", err, nil)
+	line, err = r.Next()
+	assert(t, "line", line, strings.Repeat("y", 20))
+	assert(t, "err", err, nil)
+	line, err = r.Next()
+	assert(t, "line without ending", line, "c")
+	assert(t, "err", err, nil)
+	_, err = r.Next()
+	assert(t, "end", err, io.EOF)
+
+	// the limit doesn't include the line ending
+	r = NewLineReader(strings.NewReader("abcd\r\n"))
+	r.MaxLength = 4
+	line, err = r.Next()
+	assert(t, "line at the limit", line, "abcd")
+	assert(t, "err", err, nil)
+}
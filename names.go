@@ -0,0 +1,123 @@
+package justgrep
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NameRecord is a login and display name combination a user was seen with.
+type NameRecord struct {
+	Login       string    `json:"login"`
+	DisplayName string    `json:"display_name"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	// Channels lists where the name was seen, without the #
+	Channels []string `json:"channels"`
+	Count    int      `json:"count"`
+}
+
+// NameHistory collects the names used by a single user id.
+type NameHistory struct {
+	UserID string
+
+	records map[string]*NameRecord
+}
+
+func NewNameHistory(userID string) *NameHistory {
+	return &NameHistory{UserID: userID, records: map[string]*NameRecord{}}
+}
+
+// Add records the name used in msg. Messages sent by other users or without a user-id tag are ignored.
+func (h *NameHistory) Add(msg *Message) {
+	if msg.Tags["user-id"] != h.UserID {
+		return
+	}
+	// the prefix of USERNOTICEs is the server
+	login := msg.Tags["login"]
+	if login == "" {
+		login = msg.User
+	}
+	if login == "" {
+		return
+	}
+	displayName := msg.Tags["display-name"]
+	key := login + " " + displayName
+	record, ok := h.records[key]
+	if !ok {
+		record = &NameRecord{Login: login, DisplayName: displayName, FirstSeen: msg.Timestamp, LastSeen: msg.Timestamp}
+		h.records[key] = record
+	}
+	record.Count++
+	if msg.Timestamp.Before(record.FirstSeen) {
+		record.FirstSeen = msg.Timestamp
+	}
+	if msg.Timestamp.After(record.LastSeen) {
+		record.LastSeen = msg.Timestamp
+	}
+	if len(msg.Args) != 0 && strings.HasPrefix(msg.Args[0], "#") {
+		channel := msg.Args[0][1:]
+		for _, known := range record.Channels {
+			if known == channel {
+				return
+			}
+		}
+		record.Channels = append(record.Channels, channel)
+	}
+}
+
+// Records returns the names seen so far, oldest first.
+func (h *NameHistory) Records() []NameRecord {
+	out := make([]NameRecord, 0, len(h.records))
+	for _, record := range h.records {
+		out = append(out, *record)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].FirstSeen.Equal(out[j].FirstSeen) {
+			return out[i].Login+" "+out[i].DisplayName < out[j].Login+" "+out[j].DisplayName
+		}
+		return out[i].FirstSeen.Before(out[j].FirstSeen)
+	})
+	return out
+}
+
+// CollectNames reads all logs of api between start and end and adds them to history. api should be a
+// UserJustlogAPI with IsId set, or a NewUserHistoryAPI, to only download the user's logs.
+func CollectNames(
+	ctx context.Context,
+	api JustlogAPI,
+	history *NameHistory,
+	start time.Time,
+	end time.Time,
+	client *http.Client,
+) error {
+	logs, err := api.GetAvailableLogs(ctx, client)
+	if err != nil {
+		return err
+	}
+	logs, err = logs.Snip(start, end)
+	if err != nil {
+		return err
+	}
+	for _, entry := range logs {
+		download := make(chan *Message)
+		progress := &ProgressState{TotalResults: make([]int, ResultCount)}
+		err = FetchForLogEntry(ctx, api, entry, download, progress, client)
+		if err != nil {
+			return err
+		}
+		for msg := range download {
+			if msg == nil {
+				// the download failed and was reported, keep whatever was read so far
+				continue
+			}
+			if msg.Timestamp.Before(start) || msg.Timestamp.After(end) {
+				continue
+			}
+			history.Add(msg)
+		}
+	}
+	return ctx.Err()
+}
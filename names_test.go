@@ -0,0 +1,76 @@
+package justgrep
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNameHistory(t *testing.T) {
+	lines := []string{
+		"@display-name=Old;tmi-sent-ts=1000;user-id=5 :old!old@old PRIVMSG #a :hi",
+		"@display-name=Old;tmi-sent-ts=3000;user-id=5 :old!old@old PRIVMSG #b :hi",
+		"@display-name=New;login=new;tmi-sent-ts=5000;user-id=5 :tmi.twitch.tv USERNOTICE #a :resub",
+		"@display-name=NEW;tmi-sent-ts=4000;user-id=5 :new!new@new PRIVMSG #a :hi",
+		"@display-name=Someone;tmi-sent-ts=2000;user-id=6 :someone!someone@someone PRIVMSG #a :hi",
+		"@target-user-id=5;tmi-sent-ts=6000 :tmi.twitch.tv CLEARCHAT #a :new",
+	}
+	history := NewNameHistory("5")
+	for _, line := range lines {
+		msg, err := NewMessage(line)
+		assert(t, "err", err, nil)
+		history.Add(msg)
+	}
+	records := history.Records()
+	assert(t, "record count", len(records), 3)
+
+	assert(t, "login", records[0].Login, "old")
+	assert(t, "display name", records[0].DisplayName, "Old")
+	assert(t, "first seen", records[0].FirstSeen, time.Unix(1, 0))
+	assert(t, "last seen", records[0].LastSeen, time.Unix(3, 0))
+	assert(t, "channels", strings.Join(records[0].Channels, ","), "a,b")
+	assert(t, "count", records[0].Count, 2)
+
+	assert(t, "display name change", records[1].DisplayName, "NEW")
+	assert(t, "usernotice login", records[2].Login, "new")
+	assert(t, "usernotice display name", records[2].DisplayName, "New")
+}
+
+func TestCollectNames(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/list" {
+			_, _ = fmt.Fprint(w, `{"availableLogs":[{"year":"2022","month":"2"},{"year":"2022","month":"1"}]}`)
+			return
+		}
+		assert(t, "path", strings.HasPrefix(r.URL.Path, "/channel/a/userid/5/2022/"), true)
+		month := r.URL.Path[len(r.URL.Path)-1:]
+		ts := time.Date(2022, 1, 15, 0, 0, 0, 0, time.UTC).UnixNano() / 1e6
+		if month == "2" {
+			ts = time.Date(2022, 2, 15, 0, 0, 0, 0, time.UTC).UnixNano() / 1e6
+			_, _ = fmt.Fprintf(w, "@display-name=New;tmi-sent-ts=%d;user-id=5 :new!new@new PRIVMSG #a :hi\n", ts)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "@display-name=Old;tmi-sent-ts=%d;user-id=5 :old!old@old PRIVMSG #a :hi\n", ts)
+	}))
+	defer server.Close()
+
+	api := &UserJustlogAPI{URL: server.URL, Channel: "a", User: "5", IsId: true}
+	history := NewNameHistory("5")
+	err := CollectNames(
+		context.Background(),
+		api,
+		history,
+		time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		server.Client(),
+	)
+	assert(t, "err", err, nil)
+	records := history.Records()
+	assert(t, "record count", len(records), 2)
+	assert(t, "first", records[0].Login, "old")
+	assert(t, "second", records[1].Login, "new")
+}
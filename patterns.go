@@ -0,0 +1,254 @@
+package justgrep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// PatternSet matches message text against a list of patterns. Fixed string sets use an Aho-Corasick automaton, so
+// checking a message costs the same regardless of how many patterns there are. Regex sets try every expression in
+// order.
+type PatternSet struct {
+	Patterns   []string
+	IgnoreCase bool
+
+	regexes   []*regexp.Regexp
+	automaton *ahoCorasick
+}
+
+// NewFixedPatternSet creates a PatternSet matching any of the patterns as a substring.
+func NewFixedPatternSet(patterns []string, ignoreCase bool) *PatternSet {
+	keywords := patterns
+	if ignoreCase {
+		keywords = make([]string, len(patterns))
+		for i, pattern := range patterns {
+			keywords[i] = strings.ToLower(pattern)
+		}
+	}
+	return &PatternSet{
+		Patterns:   patterns,
+		IgnoreCase: ignoreCase,
+		automaton:  newAhoCorasick(keywords),
+	}
+}
+
+// NewRegexPatternSet creates a PatternSet where every pattern is a separate regular expression.
+func NewRegexPatternSet(patterns []string, ignoreCase bool) (*PatternSet, error) {
+	regexes := make([]*regexp.Regexp, len(patterns))
+	for i, pattern := range patterns {
+		expr := pattern
+		if ignoreCase {
+			expr = "(?i)" + expr
+		}
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %d (%q): %s", i+1, pattern, err)
+		}
+		regexes[i] = regex
+	}
+	return &PatternSet{
+		Patterns:   patterns,
+		IgnoreCase: ignoreCase,
+		regexes:    regexes,
+	}, nil
+}
+
+// ReadPatterns reads one pattern per line, skipping empty lines.
+func ReadPatterns(r io.Reader) ([]string, error) {
+	var patterns []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
+
+// Match returns the index of a pattern matching text or -1 if none of them do. For fixed strings it's the pattern
+// which ends first in text, for regexes the first one in the list.
+func (s *PatternSet) Match(text string) int {
+	if s.automaton != nil {
+		if s.IgnoreCase {
+			text = strings.ToLower(text)
+		}
+		return s.automaton.find(text)
+	}
+	for i, regex := range s.regexes {
+		if regex.MatchString(text) {
+			return i
+		}
+	}
+	return -1
+}
+
+// MatchMessage returns the pattern matching the message text.
+func (s *PatternSet) MatchMessage(msg *Message) (pattern string, ok bool) {
+	if len(msg.Args) == 0 {
+		return "", false
+	}
+	idx := s.Match(msg.Args[len(msg.Args)-1])
+	if idx == -1 {
+		return "", false
+	}
+	return s.Patterns[idx], true
+}
+
+// FindAll returns the positions of all non-empty matches of any pattern in text as [start, end) byte offsets,
+// sorted by start. Matches of different patterns can overlap. It's meant for highlighting and is slower than Match.
+func (s *PatternSet) FindAll(text string) [][]int {
+	var out [][]int
+	if s.automaton == nil {
+		for _, regex := range s.regexes {
+			out = append(out, nonEmpty(regex.FindAllStringIndex(text, -1))...)
+		}
+	} else {
+		if s.IgnoreCase {
+			lower := strings.ToLower(text)
+			if len(lower) != len(text) {
+				// offsets wouldn't line up with the original text
+				return nil
+			}
+			text = lower
+		}
+		for _, pattern := range s.automaton.patterns {
+			if pattern == "" {
+				continue
+			}
+			for start := 0; ; {
+				idx := strings.Index(text[start:], pattern)
+				if idx == -1 {
+					break
+				}
+				out = append(out, []int{start + idx, start + idx + len(pattern)})
+				start += idx + len(pattern)
+			}
+		}
+	}
+	sortSpans(out)
+	return out
+}
+
+func (s *PatternSet) Filter(msg *Message) FilterResult {
+	if _, ok := s.MatchMessage(msg); !ok {
+		return ResultContent
+	}
+	return ResultOk
+}
+
+func (s *PatternSet) Reason() FilterResult {
+	return ResultContent
+}
+
+func (s *PatternSet) String() string {
+	return fmt.Sprintf("patterns:%d", len(s.Patterns))
+}
+
+// ahoCorasick is a byte-wise Aho-Corasick automaton.
+type ahoCorasick struct {
+	nodes []acNode
+	// patterns are the keywords the automaton was built from
+	patterns []string
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	// out is the index of the pattern spelled by the path to this node or -1
+	out int32
+	// outLink is the closest node reachable through fail links with out != -1, or -1
+	outLink int32
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{nodes: []acNode{{out: -1, outLink: -1}}, patterns: patterns}
+	for i, pattern := range patterns {
+		cur := int32(0)
+		for j := 0; j < len(pattern); j++ {
+			c := pattern[j]
+			nxt, ok := ac.nodes[cur].next[c]
+			if !ok {
+				if ac.nodes[cur].next == nil {
+					ac.nodes[cur].next = make(map[byte]int32)
+				}
+				nxt = int32(len(ac.nodes))
+				ac.nodes = append(ac.nodes, acNode{out: -1, outLink: -1})
+				ac.nodes[cur].next[c] = nxt
+			}
+			cur = nxt
+		}
+		if ac.nodes[cur].out == -1 {
+			ac.nodes[cur].out = int32(i)
+		}
+	}
+
+	// breadth first to set fail links, parents are always done before their children
+	queue := make([]int32, 0, len(ac.nodes))
+	for _, child := range ac.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) != 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for c, child := range ac.nodes[cur].next {
+			fail := ac.nodes[cur].fail
+			for {
+				if nxt, ok := ac.nodes[fail].next[c]; ok {
+					ac.nodes[child].fail = nxt
+					break
+				}
+				if fail == 0 {
+					ac.nodes[child].fail = 0
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			failNode := ac.nodes[ac.nodes[child].fail]
+			if failNode.out != -1 {
+				ac.nodes[child].outLink = ac.nodes[child].fail
+			} else {
+				ac.nodes[child].outLink = failNode.outLink
+			}
+			queue = append(queue, child)
+		}
+	}
+	return ac
+}
+
+// find returns the index of the pattern that ends first in text, or -1.
+func (ac *ahoCorasick) find(text string) int {
+	if ac.nodes[0].out != -1 {
+		// the empty pattern matches everything
+		return int(ac.nodes[0].out)
+	}
+	cur := int32(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		for {
+			if nxt, ok := ac.nodes[cur].next[c]; ok {
+				cur = nxt
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = ac.nodes[cur].fail
+		}
+		node := ac.nodes[cur]
+		if node.out != -1 {
+			return int(node.out)
+		}
+		if node.outLink != -1 {
+			return int(ac.nodes[node.outLink].out)
+		}
+	}
+	return -1
+}
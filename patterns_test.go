@@ -0,0 +1,65 @@
+package justgrep
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPatternSet_Fixed(t *testing.T) {
+	s := NewFixedPatternSet([]string{"he", "she", "his", "hers", "forsen"}, false)
+	cases := map[string]int{
+		"ushers":         1,
+		"this":           2,
+		"hello":          0,
+		"nothing":        -1,
+		"FORSEN":         -1,
+		"i like forsen":  4,
+		"":               -1,
+		"h e r s h i s ": -1,
+	}
+	for text, expect := range cases {
+		assert(t, "match in "+text, s.Match(text), expect)
+	}
+
+	s = NewFixedPatternSet([]string{"Forsen", "ZULUL"}, true)
+	assert(t, "ignore case", s.Match("FORSEN is here"), 0)
+	assert(t, "ignore case 2", s.Match("zulul"), 1)
+
+	s = NewFixedPatternSet([]string{"abcd", "bc"}, false)
+	assert(t, "pattern inside a longer one", s.Match("abcx"), 1)
+}
+
+func TestPatternSet_Regex(t *testing.T) {
+	s, err := NewRegexPatternSet([]string{"^!\\w+", "pajaS+"}, false)
+	assert(t, "err", err, nil)
+	assert(t, "command", s.Match("!ping"), 0)
+	assert(t, "emote", s.Match("hi pajaSSS"), 1)
+	assert(t, "nothing", s.Match("ping"), -1)
+
+	_, err = NewRegexPatternSet([]string{"("}, false)
+	if err == nil {
+		t.Errorf("expected an invalid regex to fail")
+	}
+}
+
+func TestPatternSet_MatchMessage(t *testing.T) {
+	patterns, err := ReadPatterns(strings.NewReader("nope\r\n\nmany words\n"))
+	assert(t, "err", err, nil)
+	assertStrSlc(t, "patterns", patterns, []string{"nope", "many words"})
+
+	s := NewFixedPatternSet(patterns, false)
+	pattern, ok := s.MatchMessage(getTestMessage())
+	assert(t, "ok", ok, true)
+	assert(t, "pattern", pattern, "many words")
+	assert(t, "filter", s.Filter(getTestMessage()), ResultOk)
+}
+
+func TestPatternSet_FindAll(t *testing.T) {
+	s := NewFixedPatternSet([]string{"ab", "b"}, true)
+	assert(t, "fixed", fmt.Sprint(s.FindAll("xAbab")), "[[1 3] [2 3] [3 5] [4 5]]")
+
+	s, err := NewRegexPatternSet([]string{"a+", "x*"}, false)
+	assert(t, "err", err, nil)
+	assert(t, "regex", fmt.Sprint(s.FindAll("baab")), "[[1 3]]")
+}
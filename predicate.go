@@ -0,0 +1,242 @@
+package justgrep
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Predicate decides whether a message belongs in the results.
+type Predicate interface {
+	// Filter returns ResultOk if msg matches, otherwise the reason why it was rejected.
+	Filter(msg *Message) FilterResult
+}
+
+// Reasoner is implemented by predicates which always reject messages with the same FilterResult. Not uses it to know
+// what to report when the negated predicate matches, predicates which don't implement it are reported as
+// ResultContent.
+type Reasoner interface {
+	Reason() FilterResult
+}
+
+func reasonOf(p Predicate) FilterResult {
+	if r, ok := p.(Reasoner); ok {
+		return r.Reason()
+	}
+	return ResultContent
+}
+
+// DatePredicate rejects messages sent outside of Start..End.
+type DatePredicate struct {
+	// Start < End
+	Start time.Time
+	End   time.Time
+}
+
+func (p DatePredicate) Filter(msg *Message) FilterResult {
+	if msg.Timestamp.After(p.End) {
+		return ResultDateAfterEnd
+	}
+	if msg.Timestamp.Before(p.Start) {
+		return ResultDateBeforeStart
+	}
+	return ResultOk
+}
+
+func (p DatePredicate) Reason() FilterResult {
+	return ResultDateAfterEnd
+}
+
+func (p DatePredicate) String() string {
+	return fmt.Sprintf("date:%s..%s", p.Start.Format(time.RFC3339), p.End.Format(time.RFC3339))
+}
+
+// TypePredicate only accepts messages with one of the listed IRC commands.
+type TypePredicate []string
+
+func (p TypePredicate) Filter(msg *Message) FilterResult {
+	for _, messageType := range p {
+		if messageType == msg.Action {
+			return ResultOk
+		}
+	}
+	return ResultType
+}
+
+func (p TypePredicate) Reason() FilterResult {
+	return ResultType
+}
+
+func (p TypePredicate) String() string {
+	return "type:" + strings.Join(p, ",")
+}
+
+// ContentPredicate only accepts messages where the last argument (the message text) matches Regex.
+type ContentPredicate struct {
+	Regex *regexp.Regexp
+}
+
+func (p ContentPredicate) Filter(msg *Message) FilterResult {
+	if len(msg.Args) == 0 || !p.Regex.MatchString(msg.Args[len(msg.Args)-1]) {
+		return ResultContent
+	}
+	return ResultOk
+}
+
+func (p ContentPredicate) Reason() FilterResult {
+	return ResultContent
+}
+
+func (p ContentPredicate) String() string {
+	return "msg:/" + p.Regex.String() + "/"
+}
+
+// UserPredicate matches the sender's login. Depending on MatchType either Name and NegativeName or Regex and
+// NegativeRegex are used, empty names and nil regexes are ignored.
+type UserPredicate struct {
+	MatchType UserMatchType
+
+	Regex         *regexp.Regexp
+	NegativeRegex *regexp.Regexp
+	Name          string
+	NegativeName  string
+}
+
+func (p UserPredicate) Filter(msg *Message) FilterResult {
+	switch p.MatchType {
+	case DontMatch:
+		break
+	case MatchRegex:
+		if p.Regex != nil && !p.Regex.MatchString(msg.User) {
+			return ResultUser
+		}
+
+		if p.NegativeRegex != nil && p.NegativeRegex.MatchString(msg.User) {
+			return ResultUser
+		}
+	case MatchExact:
+		if p.Name != "" && p.Name != msg.User {
+			return ResultUser
+		}
+
+		if p.NegativeName != "" && p.NegativeName == msg.User {
+			return ResultUser
+		}
+	}
+	return ResultOk
+}
+
+func (p UserPredicate) Reason() FilterResult {
+	return ResultUser
+}
+
+// UserIDPredicate only accepts messages with a matching user-id tag.
+type UserIDPredicate string
+
+func (p UserIDPredicate) Filter(msg *Message) FilterResult {
+	if msg.Tags["user-id"] != string(p) {
+		return ResultUser
+	}
+	return ResultOk
+}
+
+func (p UserIDPredicate) Reason() FilterResult {
+	return ResultUser
+}
+
+func (p UserIDPredicate) String() string {
+	return "user:#" + string(p)
+}
+
+type andPredicate []Predicate
+
+// And accepts messages accepted by all of predicates, the result of the first rejecting predicate is returned.
+func And(predicates ...Predicate) Predicate {
+	return andPredicate(predicates)
+}
+
+func (p andPredicate) Filter(msg *Message) FilterResult {
+	for _, child := range p {
+		if res := child.Filter(msg); res != ResultOk {
+			return res
+		}
+	}
+	return ResultOk
+}
+
+func (p andPredicate) Reason() FilterResult {
+	if len(p) == 0 {
+		return ResultContent
+	}
+	return reasonOf(p[0])
+}
+
+func (p andPredicate) String() string {
+	return joinPredicates(p, " AND ")
+}
+
+type orPredicate []Predicate
+
+// Or accepts messages accepted by any of predicates. If all of them reject the message, the result of the first one
+// is returned.
+func Or(predicates ...Predicate) Predicate {
+	return orPredicate(predicates)
+}
+
+func (p orPredicate) Filter(msg *Message) FilterResult {
+	first := ResultOk
+	for _, child := range p {
+		res := child.Filter(msg)
+		if res == ResultOk {
+			return ResultOk
+		}
+		if first == ResultOk {
+			first = res
+		}
+	}
+	return first
+}
+
+func (p orPredicate) Reason() FilterResult {
+	if len(p) == 0 {
+		return ResultContent
+	}
+	return reasonOf(p[0])
+}
+
+func (p orPredicate) String() string {
+	return joinPredicates(p, " OR ")
+}
+
+type notPredicate struct {
+	inner Predicate
+}
+
+// Not inverts predicate. Messages it accepts are rejected with predicate's Reason.
+func Not(predicate Predicate) Predicate {
+	return notPredicate{inner: predicate}
+}
+
+func (p notPredicate) Filter(msg *Message) FilterResult {
+	if p.inner.Filter(msg) == ResultOk {
+		return reasonOf(p.inner)
+	}
+	return ResultOk
+}
+
+func (p notPredicate) Reason() FilterResult {
+	return reasonOf(p.inner)
+}
+
+func (p notPredicate) String() string {
+	return "NOT " + fmt.Sprint(p.inner)
+}
+
+func joinPredicates(predicates []Predicate, sep string) string {
+	parts := make([]string, len(predicates))
+	for i, predicate := range predicates {
+		parts[i] = fmt.Sprint(predicate)
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
@@ -0,0 +1,64 @@
+package justgrep
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+type staffPredicate map[string]bool
+
+func (p staffPredicate) Filter(msg *Message) FilterResult {
+	if p[msg.User] {
+		return ResultOk
+	}
+	return ResultUser
+}
+
+func TestFilter_Predicate(t *testing.T) {
+	msg := getTestMessage()
+	f := Filter{
+		StartDate: time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC),
+		EndDate:   time.Date(2021, 10, 1, 0, 0, 0, 0, time.UTC),
+
+		HasMessageType: true,
+		MessageTypes:   []string{"PRIVMSG"},
+
+		HasMessageRegex: true,
+		MessageRegex:    regexp.MustCompile("words"),
+
+		UserMatchType: MatchExact,
+		UserName:      "mm2pl",
+	}
+	assert(t, "built-in checks", f.Filter(msg), ResultOk)
+
+	f.Predicates = []Predicate{staffPredicate{"pajlada": true}}
+	assert(t, "custom predicate", f.Filter(msg), ResultUser)
+
+	f.Predicates = []Predicate{Or(staffPredicate{"pajlada": true}, UserIDPredicate("117691339"))}
+	assert(t, "custom predicate in Or", f.Filter(msg), ResultOk)
+
+	f.StartDate = time.Date(2021, 9, 20, 0, 0, 0, 0, time.UTC)
+	assert(t, "date is checked first", f.Filter(msg), ResultDateBeforeStart)
+}
+
+func TestNot(t *testing.T) {
+	msg := getTestMessage()
+	assert(t, "Not(type)", Not(TypePredicate{"PRIVMSG"}).Filter(msg), ResultType)
+	assert(t, "Not(Not(type))", Not(Not(TypePredicate{"PRIVMSG"})).Filter(msg), ResultOk)
+	assert(t, "Not(custom)", Not(staffPredicate{"mm2pl": true}).Filter(msg), ResultContent)
+	assert(
+		t,
+		"Not(And(user, type))",
+		Not(And(UserIDPredicate("117691339"), TypePredicate{"PRIVMSG"})).Filter(msg),
+		ResultUser,
+	)
+}
+
+func TestFilter_PredicateValue(t *testing.T) {
+	msg := getTestMessage()
+	// a Filter value is a Predicate too
+	var p Predicate = Filter{UserMatchType: MatchExact, UserName: "mm2pl", EndDate: msg.Timestamp.Add(time.Hour)}
+	assert(t, "filter as predicate", p.Filter(msg), ResultOk)
+	assert(t, "filter literal", Filter{EndDate: msg.Timestamp.Add(time.Hour)}.Filter(msg), ResultOk)
+}
@@ -0,0 +1,117 @@
+package justgrep
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// PrefetchedLog is a log file downloaded and parsed in full by PrefetchLogEntries.
+type PrefetchedLog struct {
+	Entry    AvailableLogEntry
+	Messages []*Message
+
+	// Progress only has CountLines and CountBytes set, add them to the global ProgressState when consuming the file
+	Progress ProgressState
+	Err      error
+	// Retries is what's left of the file's RetryBudget, for downloading it again
+	Retries *RetryBudget
+}
+
+// Stream puts all messages onto the output channel and closes it. It gives up when ctx is cancelled.
+func (l PrefetchedLog) Stream(ctx context.Context, output chan *Message) {
+	defer close(output)
+	for _, msg := range l.Messages {
+		select {
+		case output <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// PrefetchLogEntries downloads and parses up to jobs entries concurrently. Results are sent in the same order as
+// entries, no matter which download finishes first. Cancelling ctx stops all outstanding downloads and closes the
+// returned channel once they have returned.
+func PrefetchLogEntries(
+	ctx context.Context,
+	api JustlogAPI,
+	entries LogsList,
+	jobs int,
+	client *http.Client,
+) <-chan PrefetchedLog {
+	if jobs < 1 {
+		jobs = 1
+	}
+	output := make(chan PrefetchedLog)
+	// pending holds results in entry order, its capacity limits how many files are kept in memory
+	pending := make(chan chan PrefetchedLog, jobs)
+	// slots limits how many files are downloaded at once, the one being read from pending still counts
+	slots := make(chan struct{}, jobs)
+	downloads := sync.WaitGroup{}
+	go func() {
+		defer close(pending)
+		for _, entry := range entries {
+			result := make(chan PrefetchedLog, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			downloads.Add(1)
+			go func(entry AvailableLogEntry) {
+				defer downloads.Done()
+				result <- prefetchLogEntry(ctx, api, entry, client)
+				<-slots
+			}(entry)
+		}
+	}()
+	go func() {
+		defer func() {
+			// results are buffered, so downloads finish without anyone reading them
+			for range pending {
+			}
+			downloads.Wait()
+			close(output)
+		}()
+		for result := range pending {
+			select {
+			case fetched := <-result:
+				select {
+				case output <- fetched:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return output
+}
+
+func prefetchLogEntry(ctx context.Context, api JustlogAPI, entry AvailableLogEntry, client *http.Client) PrefetchedLog {
+	fetched := PrefetchedLog{Entry: entry, Retries: NewRetryBudget(FetchRetryPolicy.MaxRetries)}
+	download := make(chan *Message)
+	fetched.Err = FetchForLogEntry(WithRetryBudget(ctx, fetched.Retries), api, entry, download, &fetched.Progress, client)
+	if fetched.Err != nil {
+		return fetched
+	}
+	truncated := false
+	for msg := range download {
+		if !truncated {
+			fetched.Messages = append(fetched.Messages, msg)
+		}
+		if msg == nil {
+			// the download failed and fetch already reported it. Keep the nil so Stream passes it on, the rest of the
+			// file is skipped like in StreamFilter
+			truncated = true
+		}
+	}
+	return fetched
+}
@@ -0,0 +1,93 @@
+package justgrep
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPrefetchLogEntries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /channel/test/2022/1/<day>, make earlier days slower to shuffle completion order
+		parts := strings.Split(r.URL.Path, "/")
+		day, _ := strconv.Atoi(parts[len(parts)-1])
+		time.Sleep(time.Duration(10-day) * 5 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			_, _ = fmt.Fprintf(w, "@tmi-sent-ts=%d000 :a!a@a PRIVMSG #test :day %d line %d\n", day*86400, day, i)
+		}
+	}))
+	defer server.Close()
+
+	api := &ChannelJustlogAPI{Channel: "test", URL: server.URL}
+	var entries LogsList
+	for day := 9; day > 0; day-- {
+		entries = append(entries, AvailableLogEntry{RawYear: "2022", RawMonth: "1", RawDay: strconv.Itoa(day)})
+	}
+	assert(t, "err", entries.EnsureParsed(), nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expectDay := 9
+	for fetched := range PrefetchLogEntries(ctx, api, entries, 4, server.Client()) {
+		assert(t, "err", fetched.Err, nil)
+		assert(t, "entry", fetched.Entry.Day, expectDay)
+		assert(t, "line count", len(fetched.Messages), 3)
+		assert(t, "progress line count", fetched.Progress.CountLines, 3)
+		assert(t, "first message", fetched.Messages[0].Args[1], fmt.Sprintf("day %d line 0", expectDay))
+		expectDay--
+	}
+	assert(t, "all entries fetched", expectDay, 0)
+
+	// cancelling closes the channel without waiting for the remaining entries
+	ctx, cancel = context.WithCancel(context.Background())
+	results := PrefetchLogEntries(ctx, api, entries, 2, server.Client())
+	<-results
+	cancel()
+	count := 0
+	for range results {
+		count++
+	}
+	if count > 2 {
+		t.Errorf("too many results after cancelling: %d", count)
+	}
+}
+
+func TestPrefetchLogEntriesJobs(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		_, _ = fmt.Fprintln(w, "@tmi-sent-ts=1640995200000 :a!a@a PRIVMSG #test :hello")
+		lock.Lock()
+		running--
+		lock.Unlock()
+	}))
+	defer server.Close()
+
+	api := &ChannelJustlogAPI{Channel: "test", URL: server.URL}
+	var entries LogsList
+	for day := 6; day > 0; day-- {
+		entries = append(entries, AvailableLogEntry{RawYear: "2022", RawMonth: "1", RawDay: strconv.Itoa(day)})
+	}
+	assert(t, "err", entries.EnsureParsed(), nil)
+
+	for range PrefetchLogEntries(context.Background(), api, entries, 2, server.Client()) {
+		// a slow reader leaves time for more downloads to start
+		time.Sleep(30 * time.Millisecond)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	assert(t, "concurrent downloads", maxRunning, 2)
+}
@@ -0,0 +1,379 @@
+package justgrep
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Query is a compiled boolean expression over message fields, see ParseQuery for the syntax. It implements Predicate.
+type Query struct {
+	Source string
+
+	root Predicate
+}
+
+// Filter evaluates the query tree against msg.
+func (q *Query) Filter(msg *Message) FilterResult {
+	return q.root.Filter(msg)
+}
+
+func (q *Query) Reason() FilterResult {
+	return reasonOf(q.root)
+}
+
+// String returns a normalized, fully parenthesized representation of the query.
+func (q *Query) String() string {
+	return fmt.Sprint(q.root)
+}
+
+// queryTerm is a leaf of the query tree, it remembers how it was written to make Query.String readable.
+type queryTerm struct {
+	Predicate
+	source string
+}
+
+func (t queryTerm) Reason() FilterResult {
+	return reasonOf(t.Predicate)
+}
+
+func (t queryTerm) String() string {
+	return t.source
+}
+
+// ParseQuery compiles a query string into a Query.
+//
+// Terms have the form field:value, where field is one of:
+//   - msg (alias: message), matched against the message text. A bare or "quoted" value is a case-sensitive substring,
+//     a /regex/ is a regular expression, /regex/i is case-insensitive.
+//   - user, matched against the sender's login. A bare or "quoted" value must match exactly (case-insensitive),
+//     #123 matches the user-id tag and /regex/ is a regular expression.
+//   - type (alias: action), a comma separated list of IRC commands, e.g. type:PRIVMSG,USERNOTICE.
+//
+// A term without a field is treated as msg:value.
+//
+// Terms can be combined with AND, OR and NOT (case-insensitive) and grouped with parentheses. Terms written next to
+// each other without an operator are ANDed. NOT binds tighter than AND, which binds tighter than OR.
+//
+// Example: (user:a OR user:b) AND NOT msg:/^!cmd/ AND type:PRIVMSG,USERNOTICE
+func ParseQuery(source string) (*Query, error) {
+	tokens, err := tokenizeQuery(source)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, queryError(source, len(source), "empty query")
+	}
+	p := &queryParser{source: source, tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		tok := p.peek()
+		return nil, queryError(source, tok.pos, fmt.Sprintf("unexpected %q", tok.text))
+	}
+	return &Query{Source: source, root: root}, nil
+}
+
+func queryError(source string, pos int, msg string) error {
+	return fmt.Errorf("query error at position %d in %q: %s", pos, source, msg)
+}
+
+type queryTokenKind uint8
+
+const (
+	tokenTerm queryTokenKind = iota
+	tokenOpenParen
+	tokenCloseParen
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+	pos  int
+
+	// only for tokenTerm
+	field    string
+	value    string
+	rawValue string
+	isRegex  bool
+	flags    string
+	quoted   bool
+}
+
+func tokenizeQuery(source string) ([]queryToken, error) {
+	var tokens []queryToken
+	i := 0
+	for i < len(source) {
+		switch source[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+			continue
+		case '(':
+			tokens = append(tokens, queryToken{kind: tokenOpenParen, text: "(", pos: i})
+			i++
+			continue
+		case ')':
+			tokens = append(tokens, queryToken{kind: tokenCloseParen, text: ")", pos: i})
+			i++
+			continue
+		}
+		tok, next, err := readTerm(source, i)
+		if err != nil {
+			return nil, err
+		}
+		if tok.field == "" && !tok.quoted && !tok.isRegex {
+			switch strings.ToUpper(tok.value) {
+			case "AND":
+				tok.kind = tokenAnd
+			case "OR":
+				tok.kind = tokenOr
+			case "NOT":
+				tok.kind = tokenNot
+			}
+		}
+		tokens = append(tokens, tok)
+		i = next
+	}
+	return tokens, nil
+}
+
+// readTerm reads a single [field:]value term starting at start and returns the index just after it.
+func readTerm(source string, start int) (queryToken, int, error) {
+	tok := queryToken{kind: tokenTerm, pos: start}
+	i := start
+	// field names are plain words followed by a colon
+	for j := i; j < len(source); j++ {
+		c := source[j]
+		if c == ':' && j != i {
+			tok.field = strings.ToLower(source[i:j])
+			i = j + 1
+			break
+		}
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-' || c == '_') {
+			break
+		}
+	}
+
+	valueStart := i
+	if i < len(source) && (source[i] == '"' || source[i] == '/') {
+		delim := source[i]
+		var value strings.Builder
+		j := i + 1
+		closed := false
+		for ; j < len(source); j++ {
+			c := source[j]
+			if c == '\\' && j+1 < len(source) && source[j+1] == delim {
+				value.WriteByte(delim)
+				j++
+				continue
+			}
+			if c == delim {
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return tok, 0, queryError(source, i, fmt.Sprintf("unterminated %c", delim))
+		}
+		j++
+		tok.value = value.String()
+		if delim == '/' {
+			tok.isRegex = true
+			flagsStart := j
+			for j < len(source) && source[j] >= 'a' && source[j] <= 'z' {
+				j++
+			}
+			tok.flags = source[flagsStart:j]
+		} else {
+			tok.quoted = true
+		}
+		i = j
+		if i < len(source) && !strings.ContainsRune(" \t\r\n()", rune(source[i])) {
+			return tok, 0, queryError(source, i, "expected whitespace or parenthesis after value")
+		}
+	} else {
+		j := i
+		for j < len(source) && !strings.ContainsRune(" \t\r\n()", rune(source[j])) {
+			j++
+		}
+		tok.value = source[i:j]
+		i = j
+	}
+	tok.text = source[start:i]
+	tok.rawValue = source[valueStart:i]
+	if tok.field != "" && tok.value == "" && !tok.quoted && !tok.isRegex {
+		return tok, 0, queryError(source, start, fmt.Sprintf("missing value for field %q", tok.field))
+	}
+	return tok, i, nil
+}
+
+type queryParser struct {
+	source string
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) parseOr() (Predicate, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	nodes := []Predicate{first}
+	for !p.done() && p.peek().kind == tokenOr {
+		p.pos++
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, next)
+	}
+	if len(nodes) == 1 {
+		return first, nil
+	}
+	return Or(nodes...), nil
+}
+
+func (p *queryParser) parseAnd() (Predicate, error) {
+	first, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	nodes := []Predicate{first}
+	for !p.done() {
+		kind := p.peek().kind
+		if kind == tokenAnd {
+			p.pos++
+		} else if kind != tokenTerm && kind != tokenNot && kind != tokenOpenParen {
+			break
+		}
+		next, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, next)
+	}
+	if len(nodes) == 1 {
+		return first, nil
+	}
+	return And(nodes...), nil
+}
+
+func (p *queryParser) parseNot() (Predicate, error) {
+	if !p.done() && p.peek().kind == tokenNot {
+		p.pos++
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return Not(inner), nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (Predicate, error) {
+	if p.done() {
+		return nil, queryError(p.source, len(p.source), "unexpected end of query")
+	}
+	tok := p.peek()
+	switch tok.kind {
+	case tokenOpenParen:
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.done() || p.peek().kind != tokenCloseParen {
+			return nil, queryError(p.source, tok.pos, "unclosed parenthesis")
+		}
+		p.pos++
+		return inner, nil
+	case tokenTerm:
+		p.pos++
+		return compileTerm(p.source, tok)
+	default:
+		return nil, queryError(p.source, tok.pos, fmt.Sprintf("unexpected %q", tok.text))
+	}
+}
+
+func compileTerm(source string, tok queryToken) (Predicate, error) {
+	termSource := tok.field + ":" + tok.rawValue
+	switch tok.field {
+	case "", "msg", "message":
+		var expr string
+		if tok.isRegex {
+			expr = tok.value
+		} else {
+			expr = regexp.QuoteMeta(tok.value)
+		}
+		expr, err := applyRegexFlags(expr, tok.flags)
+		if err != nil {
+			return nil, queryError(source, tok.pos, err.Error())
+		}
+		regex, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, queryError(source, tok.pos, err.Error())
+		}
+		if tok.field == "" {
+			termSource = "msg" + termSource
+		}
+		return queryTerm{ContentPredicate{Regex: regex}, termSource}, nil
+	case "user":
+		if tok.isRegex {
+			expr, err := applyRegexFlags(tok.value, tok.flags)
+			if err != nil {
+				return nil, queryError(source, tok.pos, err.Error())
+			}
+			regex, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, queryError(source, tok.pos, err.Error())
+			}
+			return queryTerm{UserPredicate{MatchType: MatchRegex, Regex: regex}, termSource}, nil
+		}
+		if !tok.quoted && strings.HasPrefix(tok.value, "#") {
+			return queryTerm{UserIDPredicate(tok.value[1:]), termSource}, nil
+		}
+		return queryTerm{UserPredicate{MatchType: MatchExact, Name: strings.ToLower(tok.value)}, termSource}, nil
+	case "type", "action":
+		if tok.isRegex {
+			return nil, queryError(source, tok.pos, "type does not accept a regex")
+		}
+		return TypePredicate(strings.Split(strings.ToUpper(tok.value), ",")), nil
+	case "tag":
+		if tok.isRegex {
+			return nil, queryError(source, tok.pos, "tag does not accept a regex, use tag:key~regex")
+		}
+		tag, err := ParseTagPredicate(tok.value)
+		if err != nil {
+			return nil, queryError(source, tok.pos, err.Error())
+		}
+		return queryTerm{tag, termSource}, nil
+	default:
+		return nil, queryError(source, tok.pos, fmt.Sprintf("unknown field %q", tok.field))
+	}
+}
+
+func applyRegexFlags(expr string, flags string) (string, error) {
+	for _, flag := range flags {
+		if flag != 'i' {
+			return "", fmt.Errorf("unknown regex flag %q", flag)
+		}
+	}
+	if flags != "" {
+		return "(?" + flags + ")" + expr, nil
+	}
+	return expr, nil
+}
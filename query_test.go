@@ -0,0 +1,74 @@
+package justgrep
+
+import (
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	cases := map[string]string{
+		"(user:a OR user:b) AND NOT msg:/!cmd/ AND type:PRIVMSG,USERNOTICE": "((user:a OR user:b) AND NOT msg:/!cmd/ AND type:PRIVMSG,USERNOTICE)",
+		"user:a OR user:b user:c":        "(user:a OR (user:b AND user:c))",
+		"not not pajaS":                  "NOT NOT msg:pajaS",
+		`msg:"hello world" or /a\/b/i`:   `(msg:"hello world" OR msg:/a\/b/i)`,
+		"((type:privmsg))":               "type:PRIVMSG",
+		"user:#117691339 AND NOT user:x": "(user:#117691339 AND NOT user:x)",
+	}
+	for source, expect := range cases {
+		q, err := ParseQuery(source)
+		if err != nil {
+			t.Errorf("unexpected error while parsing %q: %s", source, err)
+			continue
+		}
+		assert(t, "parsed "+source, q.String(), expect)
+	}
+
+	invalid := []string{
+		"",
+		"(user:a",
+		"user:a)",
+		"user:",
+		"AND user:a",
+		"msg:/unterminated",
+		"msg:/[/",
+		"foo:bar",
+		"type:/PRIVMSG/",
+		"msg:/a/x",
+	}
+	for _, source := range invalid {
+		_, err := ParseQuery(source)
+		if err == nil {
+			t.Errorf("expected an error while parsing %q", source)
+		}
+	}
+}
+
+func TestQuery_Filter(t *testing.T) {
+	msg := getTestMessage()
+	cases := map[string]FilterResult{
+		"user:mm2pl":                 ResultOk,
+		"user:MM2PL":                 ResultOk,
+		"user:pajlada":               ResultUser,
+		"user:#117691339":            ResultOk,
+		"user:/^mm/":                 ResultOk,
+		"NOT user:mm2pl":             ResultUser,
+		"user:pajlada OR user:mm2pl": ResultOk,
+		"many words":                 ResultOk,
+		"msg:/^-TAGS/":               ResultContent,
+		"msg:/^-TAGS/i":              ResultOk,
+		"type:USERNOTICE":            ResultType,
+		"type:USERNOTICE,PRIVMSG":    ResultOk,
+		"(user:a OR user:b) AND NOT msg:/^!cmd/ AND type:PRIVMSG": ResultUser,
+		"(user:a OR user:mm2pl) AND NOT msg:/^-tags/":             ResultContent,
+		"tag:subscriber=1 AND NOT tag:first-msg":                  ResultOk,
+		"tag:badges~glhf":                                         ResultOk,
+		"tag:bits>=100":                                           ResultTag,
+	}
+	for source, expect := range cases {
+		q, err := ParseQuery(source)
+		if err != nil {
+			t.Errorf("unexpected error while parsing %q: %s", source, err)
+			continue
+		}
+		assert(t, "result of "+source, q.Filter(msg), expect)
+	}
+}
@@ -0,0 +1,316 @@
+package justgrep
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const textTimeFormat = "2006-01-02 15:04:05"
+
+// ANSI escape sequences used by RenderTextWith, the same as grep's defaults where it has one
+const (
+	colorReset = "\x1b[m"
+	colorDim   = "\x1b[2m"
+	colorMatch = "\x1b[1;31m"
+	colorBold  = "\x1b[1m"
+)
+
+const (
+	actionPrefix = "\x01ACTION "
+	actionSuffix = "\x01"
+)
+
+// RenderOptions changes how RenderTextWith formats messages.
+type RenderOptions struct {
+	// Color enables ANSI escape codes: the timestamp and channel are dimmed, the user name is shown in its color tag
+	// and Highlights are marked.
+	Color bool
+
+	// Highlights are [start, end) byte offsets into the message text (the last argument) to mark, sorted and not
+	// overlapping, see Filter.MatchPositions. They are only used with Color.
+	Highlights [][]int
+
+	// HideUnknown skips commands without a dedicated format instead of showing their arguments.
+	HideUnknown bool
+
+	// Location is the time zone timestamps are shown in, nil means UTC.
+	Location *time.Location
+	// TimeFormat is a time.Format layout or one of TimeFormatRFC3339, TimeFormatUnix, TimeFormatUnixMs or
+	// TimeFormatRelative. Empty means "2006-01-02 15:04:05".
+	TimeFormat string
+	// RelativeTo is the reference point of TimeFormatRelative.
+	RelativeTo time.Time
+	// NoTime leaves out the timestamp.
+	NoTime bool
+}
+
+// Names of TimeFormat values which aren't layouts
+const (
+	TimeFormatRFC3339 = "rfc3339"
+	// TimeFormatUnix is seconds since the epoch
+	TimeFormatUnix = "unix"
+	// TimeFormatUnixMs is milliseconds since the epoch, like the tmi-sent-ts tag
+	TimeFormatUnixMs = "unixms"
+	// TimeFormatRelative is the signed duration since RenderOptions.RelativeTo, like "+1h2m3.5s"
+	TimeFormatRelative = "relative"
+)
+
+// ParseTimeZone loads an IANA time zone name. "local" is the system's time zone and an empty name is UTC.
+func ParseTimeZone(name string) (*time.Location, error) {
+	switch strings.ToLower(name) {
+	case "", "utc":
+		return time.UTC, nil
+	case "local":
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// formatTime formats ts according to TimeFormat and Location
+func (opts RenderOptions) formatTime(ts time.Time) string {
+	location := opts.Location
+	if location == nil {
+		location = time.UTC
+	}
+	switch opts.TimeFormat {
+	case "":
+		return ts.In(location).Format(textTimeFormat)
+	case TimeFormatRFC3339:
+		return ts.In(location).Format(time.RFC3339Nano)
+	case TimeFormatUnix:
+		return strconv.FormatInt(ts.Unix(), 10)
+	case TimeFormatUnixMs:
+		return strconv.FormatInt(ts.UnixNano()/int64(time.Millisecond), 10)
+	case TimeFormatRelative:
+		offset := ts.Sub(opts.RelativeTo)
+		if offset < 0 {
+			return offset.String()
+		}
+		return "+" + offset.String()
+	}
+	return ts.In(location).Format(opts.TimeFormat)
+}
+
+// RenderText formats msg as a human-readable line, like "[2006-01-02 15:04:05] #channel user: message". ok is false
+// for messages which can't be shown this way.
+func RenderText(msg *Message) (text string, ok bool) {
+	return RenderTextWith(msg, RenderOptions{})
+}
+
+// RenderTextWith works like RenderText, using opts. All of Twitch's chat commands are rendered: PRIVMSG (including
+// /me), NOTICE, USERNOTICE, CLEARCHAT, CLEARMSG, ROOMSTATE and USERSTATE. Other commands are shown as the command
+// and its arguments unless opts.HideUnknown is set.
+func RenderTextWith(msg *Message, opts RenderOptions) (text string, ok bool) {
+	r := renderer{msg: msg, opts: opts}
+	var parts []string
+	if !opts.NoTime {
+		parts = append(parts, "["+opts.formatTime(msg.Timestamp)+"]")
+	}
+	if len(msg.Args) != 0 && strings.HasPrefix(msg.Args[0], "#") {
+		parts = append(parts, msg.Args[0])
+	}
+	header := strings.Join(parts, " ")
+	if header != "" {
+		if opts.Color {
+			header = colorDim + header + colorReset
+		}
+		header += " "
+	}
+
+	switch msg.Action {
+	case "PRIVMSG":
+		if len(msg.Args) < 2 {
+			return "", false
+		}
+		if body, ok := r.action(); ok {
+			return header + fmt.Sprintf("* %s %s", r.user(msg.User), body), true
+		}
+		return header + fmt.Sprintf("%s: %s", r.user(msg.User), r.body()), true
+	case "NOTICE":
+		if len(msg.Args) < 2 {
+			return "", false
+		}
+		return header + fmt.Sprintf("NOTICE %s", r.body()), true
+	case "USERNOTICE":
+		return header + r.userNotice(), true
+	case "CLEARCHAT":
+		if len(msg.Args) < 2 {
+			return header + "Chat has been cleared", true
+		}
+		duration := msg.Tags["ban-duration"]
+		if duration == "" {
+			return header + fmt.Sprintf("%s was permanently banned", msg.Args[1]), true
+		}
+		return header + fmt.Sprintf("%s was timed out for %s seconds", msg.Args[1], duration), true
+	case "CLEARMSG":
+		login := msg.Tags["login"]
+		if login == "" {
+			login = "someone"
+		}
+		deleted := fmt.Sprintf("A message from %s was deleted", login)
+		if len(msg.Args) > 1 {
+			deleted += ": " + r.body()
+		}
+		return header + deleted, true
+	case "ROOMSTATE":
+		return header + r.roomState(), true
+	case "USERSTATE":
+		name := msg.Tags["display-name"]
+		if name == "" {
+			name = msg.User
+		}
+		state := "USERSTATE " + r.user(name)
+		if badges := msg.Tags["badges"]; badges != "" {
+			state += " with badges " + badges
+		}
+		return header + state, true
+	}
+	if opts.HideUnknown {
+		return "", false
+	}
+	args := msg.Args
+	if len(args) != 0 && strings.HasPrefix(args[0], "#") {
+		// already in the header
+		args = args[1:]
+	}
+	return header + strings.TrimSpace(msg.Action+" "+strings.Join(args, " ")), true
+}
+
+type renderer struct {
+	msg  *Message
+	opts RenderOptions
+}
+
+// body returns the message text with highlights
+func (r renderer) body() string {
+	body := r.msg.Args[len(r.msg.Args)-1]
+	if r.opts.Color {
+		return Highlight(body, r.opts.Highlights)
+	}
+	return body
+}
+
+// action returns the text of a /me message with highlights
+func (r renderer) action() (string, bool) {
+	if !r.msg.IsAction() {
+		return "", false
+	}
+	body := r.msg.Text()
+	if !r.opts.Color {
+		return body, true
+	}
+	spans := make([][]int, 0, len(r.opts.Highlights))
+	for _, span := range r.opts.Highlights {
+		spans = append(spans, []int{span[0] - len(actionPrefix), span[1] - len(actionPrefix)})
+	}
+	return Highlight(body, spans), true
+}
+
+func (r renderer) user(name string) string {
+	if r.opts.Color {
+		return UserColor(r.msg) + name + colorReset
+	}
+	return name
+}
+
+// userNotice renders subs, gifts, raids, announcements and the like using the system-msg tag
+func (r renderer) userNotice() string {
+	msg := r.msg
+	login := msg.Tags["login"]
+	if login == "" {
+		login = msg.User
+	}
+	text := msg.Tags["system-msg"]
+	if text == "" {
+		// announcements don't have a system-msg
+		text = strings.ToUpper(msg.Tags["msg-id"])
+		if text == "" {
+			text = "USERNOTICE"
+		}
+	}
+	if len(msg.Args) > 1 {
+		text += fmt.Sprintf(" %s: %s", r.user(login), r.body())
+	}
+	return text
+}
+
+// roomState lists the chat modes set in a ROOMSTATE
+func (r renderer) roomState() string {
+	var modes []string
+	for key, value := range r.msg.Tags {
+		var mode string
+		switch key {
+		case "emote-only", "r9k", "subs-only", "rituals":
+			mode = key + " off"
+			if value == "1" {
+				mode = key + " on"
+			}
+		case "followers-only":
+			switch value {
+			case "-1":
+				mode = key + " off"
+			case "0":
+				mode = key + " on"
+			default:
+				mode = fmt.Sprintf("%s %s minutes", key, value)
+			}
+		case "slow":
+			mode = "slow off"
+			if value != "0" {
+				mode = fmt.Sprintf("slow %s seconds", value)
+			}
+		default:
+			continue
+		}
+		modes = append(modes, mode)
+	}
+	if len(modes) == 0 {
+		return "ROOMSTATE"
+	}
+	sort.Strings(modes)
+	return "ROOMSTATE " + strings.Join(modes, ", ")
+}
+
+// Highlight marks the spans of text with grep's match color. Spans have to be sorted and not overlap, ones outside
+// of text are ignored.
+func Highlight(text string, spans [][]int) string {
+	if len(spans) == 0 {
+		return text
+	}
+	out := strings.Builder{}
+	last := 0
+	for _, span := range spans {
+		if span[0] < last || span[1] > len(text) || span[0] >= span[1] {
+			continue
+		}
+		out.WriteString(text[last:span[0]])
+		out.WriteString(colorMatch)
+		out.WriteString(text[span[0]:span[1]])
+		out.WriteString(colorReset)
+		last = span[1]
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+// UserColor returns the escape sequence for the sender's color tag ("#RRGGBB") as a bold 24-bit color. Users without
+// a valid color are only bold.
+func UserColor(msg *Message) string {
+	color := msg.Tags["color"]
+	if len(color) != 7 || color[0] != '#' {
+		return colorBold
+	}
+	rgb, err := strconv.ParseUint(color[1:], 16, 32)
+	if err != nil {
+		return colorBold
+	}
+	return fmt.Sprintf("\x1b[1;38;2;%d;%d;%dm", rgb>>16, (rgb>>8)&0xff, rgb&0xff)
+}
+
+// Dim returns text in the faint color used for timestamps and channels.
+func Dim(text string) string {
+	return colorDim + text + colorReset
+}
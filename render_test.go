@@ -0,0 +1,175 @@
+package justgrep
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenderText(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected string
+		ok       bool
+	}{
+		{
+			"@tmi-sent-ts=1641013200000 :a!a@a PRIVMSG #forsen :hello",
+			"[2022-01-01 05:00:00] #forsen a: hello",
+			true,
+		},
+		{
+			"@tmi-sent-ts=1641013200000 :tmi.twitch.tv NOTICE #forsen :This room is now in emote-only mode.",
+			"[2022-01-01 05:00:00] #forsen NOTICE This room is now in emote-only mode.",
+			true,
+		},
+		{
+			"@tmi-sent-ts=1641013200000 :tmi.twitch.tv CLEARCHAT #forsen",
+			"[2022-01-01 05:00:00] #forsen Chat has been cleared",
+			true,
+		},
+		{
+			"@ban-duration=600;tmi-sent-ts=1641013200000 :tmi.twitch.tv CLEARCHAT #forsen :a",
+			"[2022-01-01 05:00:00] #forsen a was timed out for 600 seconds",
+			true,
+		},
+		{
+			"@tmi-sent-ts=1641013200000 :tmi.twitch.tv CLEARCHAT #forsen :a",
+			"[2022-01-01 05:00:00] #forsen a was permanently banned",
+			true,
+		},
+		{
+			"@tmi-sent-ts=1641013200000 :a!a@a PRIVMSG #forsen :\x01ACTION waves\x01",
+			"[2022-01-01 05:00:00] #forsen * a waves",
+			true,
+		},
+		{
+			"@login=a;msg-id=resub;system-msg=a\\ssubscribed\\sat\\sTier\\s1.;tmi-sent-ts=1641013200000 " +
+				":tmi.twitch.tv USERNOTICE #forsen :hello",
+			"[2022-01-01 05:00:00] #forsen a subscribed at Tier 1. a: hello",
+			true,
+		},
+		{
+			"@login=a;msg-id=raid;system-msg=5\\sraiders\\sfrom\\sa\\shave\\sjoined!;tmi-sent-ts=1641013200000 " +
+				":tmi.twitch.tv USERNOTICE #forsen",
+			"[2022-01-01 05:00:00] #forsen 5 raiders from a have joined!",
+			true,
+		},
+		{
+			"@login=a;msg-id=announcement;tmi-sent-ts=1641013200000 :tmi.twitch.tv USERNOTICE #forsen :hi chat",
+			"[2022-01-01 05:00:00] #forsen ANNOUNCEMENT a: hi chat",
+			true,
+		},
+		{
+			"@login=a;target-msg-id=abc;tmi-sent-ts=1641013200000 :tmi.twitch.tv CLEARMSG #forsen :bad words",
+			"[2022-01-01 05:00:00] #forsen A message from a was deleted: bad words",
+			true,
+		},
+		{
+			"@emote-only=1;room-id=1;slow=30;tmi-sent-ts=1641013200000 :tmi.twitch.tv ROOMSTATE #forsen",
+			"[2022-01-01 05:00:00] #forsen ROOMSTATE emote-only on, slow 30 seconds",
+			true,
+		},
+		{
+			"@badges=moderator/1;display-name=A;tmi-sent-ts=1641013200000 :tmi.twitch.tv USERSTATE #forsen",
+			"[2022-01-01 05:00:00] #forsen USERSTATE A with badges moderator/1",
+			true,
+		},
+		{
+			"@tmi-sent-ts=1641013200000 :tmi.twitch.tv HOSTTARGET #forsen :xqc 10",
+			"[2022-01-01 05:00:00] #forsen HOSTTARGET xqc 10",
+			true,
+		},
+		{":tmi.twitch.tv RECONNECT", "[0001-01-01 00:00:00] RECONNECT", true},
+	}
+	for _, test := range tests {
+		msg, err := NewMessage(test.raw)
+		assert(t, "err", err, nil)
+		text, ok := RenderText(msg)
+		assert(t, test.raw+" ok", ok, test.ok)
+		assert(t, test.raw, text, test.expected)
+	}
+}
+
+func TestRenderTextWith(t *testing.T) {
+	msg, err := NewMessage("@color=#FF7F00;tmi-sent-ts=1641013200000 :a!a@a PRIVMSG #forsen :hello there")
+	assert(t, "err", err, nil)
+	text, ok := RenderTextWith(msg, RenderOptions{Color: true, Highlights: [][]int{{0, 5}}})
+	assert(t, "ok", ok, true)
+	assert(
+		t,
+		"colored",
+		text,
+		"\x1b[2m[2022-01-01 05:00:00] #forsen\x1b[m \x1b[1;38;2;255;127;0ma\x1b[m: \x1b[1;31mhello\x1b[m there",
+	)
+
+	text, _ = RenderTextWith(msg, RenderOptions{Highlights: [][]int{{0, 5}}})
+	assert(t, "no color", text, "[2022-01-01 05:00:00] #forsen a: hello there")
+}
+
+func TestRenderTextWith_HideUnknown(t *testing.T) {
+	msg, err := NewMessage("@tmi-sent-ts=1641013200000 :tmi.twitch.tv HOSTTARGET #forsen :xqc 10")
+	assert(t, "err", err, nil)
+	_, ok := RenderTextWith(msg, RenderOptions{HideUnknown: true})
+	assert(t, "hidden", ok, false)
+
+	msg, err = NewMessage("@tmi-sent-ts=1641013200000 :a!a@a PRIVMSG #forsen :\x01ACTION waves\x01")
+	assert(t, "err", err, nil)
+	text, _ := RenderTextWith(msg, RenderOptions{Color: true, Highlights: [][]int{{8, 13}}})
+	assert(
+		t,
+		"action highlight",
+		text,
+		"\x1b[2m[2022-01-01 05:00:00] #forsen\x1b[m * \x1b[1ma\x1b[m \x1b[1;31mwaves\x1b[m",
+	)
+}
+
+func TestHighlight(t *testing.T) {
+	assert(t, "spans", Highlight("abcdef", [][]int{{1, 2}, {4, 6}}), "a\x1b[1;31mb\x1b[mcd\x1b[1;31mef\x1b[m")
+	assert(t, "out of range", Highlight("abc", [][]int{{1, 9}}), "abc")
+}
+
+func TestRenderTextWith_Time(t *testing.T) {
+	msg, err := NewMessage("@tmi-sent-ts=1641013265500 :a!a@a PRIVMSG #forsen :hi")
+	assert(t, "err", err, nil)
+	warsaw, err := ParseTimeZone("Europe/Warsaw")
+	assert(t, "err", err, nil)
+	tests := []struct {
+		name     string
+		opts     RenderOptions
+		expected string
+	}{
+		{"zone", RenderOptions{Location: warsaw}, "[2022-01-01 06:01:05] #forsen a: hi"},
+		{"layout", RenderOptions{Location: warsaw, TimeFormat: "15:04"}, "[06:01] #forsen a: hi"},
+		{
+			"rfc3339",
+			RenderOptions{Location: warsaw, TimeFormat: TimeFormatRFC3339},
+			"[2022-01-01T06:01:05.5+01:00] #forsen a: hi",
+		},
+		{"unix", RenderOptions{TimeFormat: TimeFormatUnix}, "[1641013265] #forsen a: hi"},
+		{"unixms", RenderOptions{TimeFormat: TimeFormatUnixMs}, "[1641013265500] #forsen a: hi"},
+		{
+			"relative",
+			RenderOptions{TimeFormat: TimeFormatRelative, RelativeTo: time.Unix(1641013200, 0)},
+			"[+1m5.5s] #forsen a: hi",
+		},
+		{
+			"relative before",
+			RenderOptions{TimeFormat: TimeFormatRelative, RelativeTo: time.Unix(1641013300, 0)},
+			"[-34.5s] #forsen a: hi",
+		},
+		{"no time", RenderOptions{NoTime: true}, "#forsen a: hi"},
+	}
+	for _, test := range tests {
+		text, _ := RenderTextWith(msg, test.opts)
+		assert(t, test.name, text, test.expected)
+	}
+}
+
+func TestParseTimeZone(t *testing.T) {
+	location, err := ParseTimeZone("")
+	assert(t, "empty", location, time.UTC)
+	assert(t, "err", err, nil)
+	location, _ = ParseTimeZone("local")
+	assert(t, "local", location, time.Local)
+	_, err = ParseTimeZone("Nowhere/Nothing")
+	assert(t, "invalid", err != nil, true)
+}
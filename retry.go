@@ -0,0 +1,184 @@
+package justgrep
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// RetryPolicy describes how failed downloads are retried. Delays grow exponentially from InitialDelay up to MaxDelay,
+// every delay is randomized to between half and all of it.
+type RetryPolicy struct {
+	// MaxRetries is the number of additional attempts, 0 disables retrying
+	MaxRetries   int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+
+	// OnRetry is called before waiting for the next attempt
+	OnRetry func(url string, attempt int, delay time.Duration, err error)
+	// OnFailure is called when a download in progress fails for good, errors before any data was received are
+	// returned from FetchForDate instead. If nil, the error is printed to stderr.
+	OnFailure func(url string, err error)
+}
+
+// FetchRetryPolicy is used by FetchForDate for all downloads.
+var FetchRetryPolicy = RetryPolicy{
+	MaxRetries:   3,
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+}
+
+// RetryBudget counts the retries of all requests made for one log file. Sharing one between the first request,
+// resumed downloads and downloads of the whole file started again keeps them from multiplying each other's retries.
+type RetryBudget struct {
+	lock sync.Mutex
+	max  int
+	used int
+}
+
+func NewRetryBudget(max int) *RetryBudget {
+	return &RetryBudget{max: max}
+}
+
+// Take uses up a retry and returns its number starting at 1, ok is false if none are left.
+func (b *RetryBudget) Take() (attempt int, ok bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.used >= b.max {
+		return b.used, false
+	}
+	b.used++
+	return b.used, true
+}
+
+type retryBudgetKey struct{}
+
+// WithRetryBudget makes FetchForDate take retries from budget instead of starting with FetchRetryPolicy.MaxRetries.
+func WithRetryBudget(ctx context.Context, budget *RetryBudget) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+// retryBudget returns the budget of ctx or a new one for policy
+func retryBudget(ctx context.Context, policy RetryPolicy) *RetryBudget {
+	if budget, ok := ctx.Value(retryBudgetKey{}).(*RetryBudget); ok {
+		return budget
+	}
+	return NewRetryBudget(policy.MaxRetries)
+}
+
+// Delay returns how long to wait before the given retry, attempt starts at 1.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay != 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// Wait calls OnRetry and sleeps for the delay of the given attempt. It returns false if ctx was cancelled in the
+// meantime.
+func (p RetryPolicy) Wait(ctx context.Context, url string, attempt int, err error) bool {
+	delay := p.Delay(attempt)
+	if p.OnRetry != nil {
+		p.OnRetry(url, attempt, delay, err)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p RetryPolicy) failed(url string, err error) {
+	if p.OnFailure != nil {
+		p.OnFailure(url, err)
+		return
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Error while fetching from %s: %s\n", url, err)
+}
+
+// statusError is returned for non-200 responses
+type statusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e statusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("justlog instance responded with %d: %q", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("justlog instance responded with unexpected %d status code", e.StatusCode)
+}
+
+// isRetryable tells if an error from openURL might go away when trying again.
+func isRetryable(err error) bool {
+	var status statusError
+	if errors.As(err, &status) {
+		return status.StatusCode >= 500 || status.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// openURL requests url, retrying according to policy as long as budget allows.
+func openURL(
+	ctx context.Context,
+	url string,
+	client *http.Client,
+	policy RetryPolicy,
+	budget *RetryBudget,
+) (io.ReadCloser, error) {
+	for {
+		body, err := requestURL(ctx, url, client)
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil || !isRetryable(err) {
+			return nil, err
+		}
+		attempt, ok := budget.Take()
+		if !ok {
+			return nil, err
+		}
+		if !policy.Wait(ctx, url, attempt, err) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func requestURL(ctx context.Context, url string, client *http.Client) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", UserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		scanner := bufio.NewScanner(resp.Body)
+		if scanner.Scan() {
+			return nil, statusError{StatusCode: resp.StatusCode, Message: scanner.Text()}
+		}
+		return nil, statusError{StatusCode: resp.StatusCode}
+	}
+	return resp.Body, nil
+}
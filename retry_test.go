@@ -0,0 +1,222 @@
+package justgrep
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testRetryPolicy(t *testing.T) *[]string {
+	old := FetchRetryPolicy
+	t.Cleanup(func() {
+		FetchRetryPolicy = old
+	})
+	var lock sync.Mutex
+	var events []string
+	FetchRetryPolicy = RetryPolicy{
+		MaxRetries:   2,
+		InitialDelay: time.Millisecond,
+		MaxDelay:     time.Millisecond,
+		OnRetry: func(url string, attempt int, delay time.Duration, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, fmt.Sprintf("retry %d", attempt))
+		},
+		OnFailure: func(url string, err error) {
+			lock.Lock()
+			defer lock.Unlock()
+			events = append(events, "failure")
+		},
+	}
+	return &events
+}
+
+func collectMessages(t *testing.T, api JustlogAPI, client *http.Client) ([]string, error) {
+	output := make(chan *Message)
+	progress := &ProgressState{TotalResults: make([]int, ResultCount)}
+	date := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := FetchForDate(context.Background(), api, date, output, progress, client)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	lines := 0
+	for msg := range output {
+		if msg == nil {
+			out = append(out, "<nil>")
+			continue
+		}
+		lines++
+		out = append(out, msg.Args[1])
+	}
+	assert(t, "progress line count", progress.CountLines, lines)
+	return out, nil
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		expected *= time.Millisecond
+		delay := policy.Delay(attempt + 1)
+		if delay < expected/2 || delay > expected {
+			t.Errorf("attempt %d: delay %s outside of %s..%s", attempt+1, delay, expected/2, expected)
+		}
+	}
+}
+
+func TestFetchRetriesFailedRequests(t *testing.T) {
+	events := testRetryPolicy(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "@tmi-sent-ts=1640995200000 :a!a@a PRIVMSG #test :hello")
+	}))
+	defer server.Close()
+
+	api := &ChannelJustlogAPI{Channel: "test", URL: server.URL}
+	messages, err := collectMessages(t, api, server.Client())
+	assert(t, "err", err, nil)
+	assert(t, "messages", strings.Join(messages, ","), "hello")
+	assert(t, "events", strings.Join(*events, ","), "retry 1,retry 2")
+
+	// client errors are not retried
+	*events = nil
+	requests = 0
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	})
+	_, err = collectMessages(t, api, server.Client())
+	if err == nil {
+		t.Errorf("expected an error for a 404 response")
+	}
+	assert(t, "requests", requests, 1)
+	assert(t, "events", len(*events), 0)
+}
+
+func TestFetchSharesRetryBudget(t *testing.T) {
+	events := testRetryPolicy(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	api := &ChannelJustlogAPI{Channel: "test", URL: server.URL}
+	ctx := WithRetryBudget(context.Background(), NewRetryBudget(FetchRetryPolicy.MaxRetries))
+	date := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	progress := &ProgressState{TotalResults: make([]int, ResultCount)}
+	for i := 0; i < 2; i++ {
+		_, err := FetchForDate(ctx, api, date, make(chan *Message), progress, server.Client())
+		if err == nil {
+			t.Errorf("expected an error for a 502 response")
+		}
+	}
+	// the second download gets no retries of its own
+	assert(t, "requests", requests, 4)
+	assert(t, "events", strings.Join(*events, ","), "retry 1,retry 2")
+}
+
+// truncatingHandler serves lines, the first attempts are cut off after cutAfter lines and cutBytes more bytes. New
+// lines can show up at the top of the file between attempts, like in a reversed log file of the current day.
+type truncatingHandler struct {
+	lines    []string
+	cutAfter int
+	cutBytes int
+	failures int
+	prepend  []string
+	requests int
+	lock     sync.Mutex
+}
+
+func (h *truncatingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.lock.Lock()
+	h.requests++
+	requests := h.requests
+	lines := h.lines
+	if requests > 1 {
+		lines = append(append([]string(nil), h.prepend...), h.lines...)
+	}
+	h.lock.Unlock()
+
+	body := ""
+	for _, line := range lines {
+		body += fmt.Sprintf("@tmi-sent-ts=1640995200000 :a!a@a PRIVMSG #test :%s\n", line)
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	if requests <= h.failures {
+		cut := 0
+		for i := 0; i < h.cutAfter; i++ {
+			cut += strings.IndexByte(body[cut:], '\n') + 1
+		}
+		cut += h.cutBytes
+		// the client sees an unexpected EOF
+		_, _ = w.Write([]byte(body[:cut]))
+		return
+	}
+	_, _ = w.Write([]byte(body))
+}
+
+func TestFetchResumesInterruptedDownloads(t *testing.T) {
+	events := testRetryPolicy(t)
+	handler := &truncatingHandler{
+		lines:    []string{"c", "b", "a"},
+		cutAfter: 2,
+		failures: 1,
+		prepend:  []string{"new"},
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	api := &ChannelJustlogAPI{Channel: "test", URL: server.URL}
+	messages, err := collectMessages(t, api, server.Client())
+	assert(t, "err", err, nil)
+	assert(t, "messages", strings.Join(messages, ","), "c,b,a")
+	assert(t, "events", strings.Join(*events, ","), "retry 1")
+
+	// giving up sends nil after the messages received so far
+	*events = nil
+	handler.requests = 0
+	handler.failures = 10
+	messages, err = collectMessages(t, api, server.Client())
+	assert(t, "err", err, nil)
+	assert(t, "messages", strings.Join(messages, ","), "c,b,<nil>")
+	assert(t, "events", strings.Join(*events, ","), "retry 1,retry 2,failure")
+}
+
+func TestFetchDropsPartialLines(t *testing.T) {
+	events := testRetryPolicy(t)
+	handler := &truncatingHandler{
+		lines:    []string{"ccc", "bbbbbbbb", "aaa"},
+		cutAfter: 1,
+		// in the middle of "bbbbbbbb"
+		cutBytes: len("@tmi-sent-ts=1640995200000 :a!a@a PRIVMSG #test :bbbb"),
+		failures: 1,
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	api := &ChannelJustlogAPI{Channel: "test", URL: server.URL}
+	messages, err := collectMessages(t, api, server.Client())
+	assert(t, "err", err, nil)
+	assert(t, "messages", strings.Join(messages, ","), "ccc,bbbbbbbb,aaa")
+	assert(t, "events", strings.Join(*events, ","), "retry 1")
+
+	// without retries the partial line isn't sent either
+	*events = nil
+	handler.requests = 0
+	handler.failures = 10
+	messages, err = collectMessages(t, api, server.Client())
+	assert(t, "err", err, nil)
+	assert(t, "messages", strings.Join(messages, ","), "ccc,<nil>")
+}
@@ -0,0 +1,78 @@
+package justgrep
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// ParseStats counts the lines of an IRC stream by command and the lines which couldn't be parsed by the kind of
+// error.
+type ParseStats struct {
+	Lines    int
+	Commands *Counter
+	// Errors are keyed by ParseError.Kind, or the whole message for other errors
+	Errors *Counter
+}
+
+func NewParseStats() *ParseStats {
+	commands, byKey, _ := ParseGroupBy("type", time.UTC)
+	return &ParseStats{
+		Commands: NewCounter(commands, byKey),
+		Errors:   &Counter{Counts: make(map[string]int)},
+	}
+}
+
+// Add counts a line given the results of NewMessage.
+func (s *ParseStats) Add(msg *Message, err error) {
+	s.Lines++
+	if err == nil {
+		s.Commands.Add(msg)
+		return
+	}
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		s.Errors.Counts[parseErr.Kind]++
+	} else {
+		s.Errors.Counts[err.Error()]++
+	}
+}
+
+// WriteText writes the counts as a human-readable table, most common first.
+func (s *ParseStats) WriteText(w io.Writer) {
+	errorCount := 0
+	for _, count := range s.Errors.Counts {
+		errorCount += count
+	}
+	_, _ = fmt.Fprintf(w, "%d lines, %d parsed, %d failed\n", s.Lines, s.Lines-errorCount, errorCount)
+	for _, section := range []struct {
+		name    string
+		counter *Counter
+	}{{"Commands", s.Commands}, {"Errors", s.Errors}} {
+		entries := section.counter.Sorted()
+		if len(entries) == 0 {
+			continue
+		}
+		width := 1
+		for _, entry := range entries {
+			if w := len(strconv.Itoa(entry.Count)); w > width {
+				width = w
+			}
+		}
+		_, _ = fmt.Fprintf(w, "%s:\n", section.name)
+		for _, entry := range entries {
+			_, _ = fmt.Fprintf(w, " %*d %s\n", width, entry.Count, entry.Key)
+		}
+	}
+}
+
+func (s *ParseStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Lines    int            `json:"lines"`
+		Commands map[string]int `json:"commands"`
+		Errors   map[string]int `json:"errors"`
+	}{s.Lines, s.Commands.Counts, s.Errors.Counts})
+}
@@ -0,0 +1,45 @@
+package justgrep
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParseStats(t *testing.T) {
+	stats := NewParseStats()
+	for _, line := range []string{
+		"@tmi-sent-ts=1000 :a!a@a PRIVMSG #a :hi",
+		"@tmi-sent-ts=2000 :b!b@b PRIVMSG #a :hi",
+		"@tmi-sent-ts=x :a!a@a PRIVMSG #a :hi",
+		"@tmi-sent-ts=y :a!a@a PRIVMSG #a :hi",
+		"",
+		":tmi.twitch.tv PING",
+	} {
+		msg, err := NewMessage(line)
+		stats.Add(msg, err)
+	}
+	stats.Add(nil, errors.New("something else"))
+
+	out := &bytes.Buffer{}
+	stats.WriteText(out)
+	assert(
+		t,
+		"text",
+		out.String(),
+		"7 lines, 3 parsed, 4 failed\n"+
+			"Commands:\n 2 PRIVMSG\n 1 PING\n"+
+			"Errors:\n 2 unable to parse time (@tmi-sent-ts)\n 1 empty input\n 1 something else\n",
+	)
+
+	data, err := json.Marshal(stats)
+	assert(t, "err", err, nil)
+	assert(
+		t,
+		"json",
+		string(data),
+		`{"lines":7,"commands":{"PING":1,"PRIVMSG":2},`+
+			`"errors":{"empty input":1,"something else":1,"unable to parse time (@tmi-sent-ts)":2}}`,
+	)
+}
@@ -0,0 +1,183 @@
+package justgrep
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type TagOperator uint8
+
+const (
+	TagPresent TagOperator = iota
+	TagAbsent
+	TagEqual
+	TagNotEqual
+	TagRegex
+	TagLess
+	TagLessEqual
+	TagGreater
+	TagGreaterEqual
+)
+
+func (op TagOperator) String() string {
+	switch op {
+	case TagPresent:
+		return ""
+	case TagAbsent:
+		return "!"
+	case TagEqual:
+		return "="
+	case TagNotEqual:
+		return "!="
+	case TagRegex:
+		return "~"
+	case TagLess:
+		return "<"
+	case TagLessEqual:
+		return "<="
+	case TagGreater:
+		return ">"
+	case TagGreaterEqual:
+		return ">="
+	default:
+		return strconv.FormatInt(int64(op), 10)
+	}
+}
+
+// TagPredicate matches a single IRCv3 tag of a message, see ParseTagPredicate.
+type TagPredicate struct {
+	Key      string
+	Operator TagOperator
+
+	// Value is used by TagEqual and TagNotEqual
+	Value string
+	// Regex is used by TagRegex
+	Regex *regexp.Regexp
+	// Number is used by numeric comparisons, messages with tag values that aren't numbers are rejected
+	Number float64
+}
+
+// ParseTagPredicate parses a tag expression. Accepted forms are:
+//   - key: the tag is present
+//   - !key: the tag is absent
+//   - key=value, key!=value: the tag is (not) equal to value, a missing tag is never equal
+//   - key~regex: the tag value matches the regular expression
+//   - key<N, key<=N, key>N, key>=N: the tag value is a number and compares to N
+func ParseTagPredicate(expr string) (TagPredicate, error) {
+	if expr == "" {
+		return TagPredicate{}, errors.New("tag expression: empty expression")
+	}
+	if strings.HasPrefix(expr, "!") && !strings.ContainsAny(expr[1:], "=!~<>") {
+		if len(expr) == 1 {
+			return TagPredicate{}, errors.New("tag expression: missing tag name")
+		}
+		return TagPredicate{Key: expr[1:], Operator: TagAbsent}, nil
+	}
+	opIdx := strings.IndexAny(expr, "=!~<>")
+	if opIdx == -1 {
+		return TagPredicate{Key: expr, Operator: TagPresent}, nil
+	}
+	if opIdx == 0 {
+		return TagPredicate{}, fmt.Errorf("tag expression %q: missing tag name", expr)
+	}
+	p := TagPredicate{Key: expr[:opIdx]}
+	rest := expr[opIdx:]
+	var value string
+	switch {
+	case strings.HasPrefix(rest, "!="):
+		p.Operator, value = TagNotEqual, rest[2:]
+	case strings.HasPrefix(rest, "<="):
+		p.Operator, value = TagLessEqual, rest[2:]
+	case strings.HasPrefix(rest, ">="):
+		p.Operator, value = TagGreaterEqual, rest[2:]
+	case rest[0] == '=':
+		p.Operator, value = TagEqual, rest[1:]
+	case rest[0] == '~':
+		p.Operator, value = TagRegex, rest[1:]
+	case rest[0] == '<':
+		p.Operator, value = TagLess, rest[1:]
+	case rest[0] == '>':
+		p.Operator, value = TagGreater, rest[1:]
+	default:
+		return TagPredicate{}, fmt.Errorf("tag expression %q: unknown operator", expr)
+	}
+
+	switch p.Operator {
+	case TagEqual, TagNotEqual:
+		p.Value = value
+	case TagRegex:
+		regex, err := regexp.Compile(value)
+		if err != nil {
+			return TagPredicate{}, fmt.Errorf("tag expression %q: %s", expr, err)
+		}
+		p.Regex = regex
+	default:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return TagPredicate{}, fmt.Errorf("tag expression %q: %q is not a number", expr, value)
+		}
+		p.Number = number
+	}
+	return p, nil
+}
+
+func (p TagPredicate) Filter(msg *Message) FilterResult {
+	value, ok := msg.Tags[p.Key]
+	switch p.Operator {
+	case TagPresent:
+		// ok is already correct
+	case TagAbsent:
+		ok = !ok
+	case TagEqual:
+		ok = ok && value == p.Value
+	case TagNotEqual:
+		ok = !ok || value != p.Value
+	case TagRegex:
+		ok = ok && p.Regex.MatchString(value)
+	default:
+		if !ok {
+			break
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			ok = false
+			break
+		}
+		switch p.Operator {
+		case TagLess:
+			ok = number < p.Number
+		case TagLessEqual:
+			ok = number <= p.Number
+		case TagGreater:
+			ok = number > p.Number
+		case TagGreaterEqual:
+			ok = number >= p.Number
+		}
+	}
+	if !ok {
+		return ResultTag
+	}
+	return ResultOk
+}
+
+func (p TagPredicate) Reason() FilterResult {
+	return ResultTag
+}
+
+func (p TagPredicate) String() string {
+	switch p.Operator {
+	case TagPresent:
+		return p.Key
+	case TagAbsent:
+		return "!" + p.Key
+	case TagEqual, TagNotEqual:
+		return p.Key + p.Operator.String() + p.Value
+	case TagRegex:
+		return p.Key + "~" + p.Regex.String()
+	default:
+		return p.Key + p.Operator.String() + strconv.FormatFloat(p.Number, 'f', -1, 64)
+	}
+}
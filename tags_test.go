@@ -0,0 +1,65 @@
+package justgrep
+
+import (
+	"testing"
+)
+
+func TestParseTagPredicate(t *testing.T) {
+	cases := map[string]string{
+		"first-msg":               "first-msg",
+		"!first-msg":              "!first-msg",
+		"msg-id=raid":             "msg-id=raid",
+		"msg-id!=raid":            "msg-id!=raid",
+		"badges~(^|,)moderator/1": "badges~(^|,)moderator/1",
+		"bits>=100":               "bits>=100",
+		"bits>1.5":                "bits>1.5",
+		"bits<=100":               "bits<=100",
+		"bits<100":                "bits<100",
+		"display-name=":           "display-name=",
+		"system-msg=a=b":          "system-msg=a=b",
+	}
+	for expr, expect := range cases {
+		p, err := ParseTagPredicate(expr)
+		if err != nil {
+			t.Errorf("unexpected error while parsing %q: %s", expr, err)
+			continue
+		}
+		assert(t, "parsed "+expr, p.String(), expect)
+	}
+
+	for _, expr := range []string{"", "!", "=raid", "bits>=lots", "badges~["} {
+		_, err := ParseTagPredicate(expr)
+		if err == nil {
+			t.Errorf("expected an error while parsing %q", expr)
+		}
+	}
+}
+
+func TestTagPredicate_Filter(t *testing.T) {
+	msg := getTestMessage()
+	msg.Tags["bits"] = "100"
+	cases := map[string]FilterResult{
+		"bits":                    ResultOk,
+		"first-msg":               ResultTag,
+		"!first-msg":              ResultOk,
+		"subscriber=1":            ResultOk,
+		"subscriber=0":            ResultTag,
+		"subscriber!=0":           ResultOk,
+		"first-msg!=1":            ResultOk,
+		"badges~(^|,)subscriber/": ResultOk,
+		"badges~moderator/1":      ResultTag,
+		"bits>=100":               ResultOk,
+		"bits>100":                ResultTag,
+		"bits<101":                ResultOk,
+		"color<100":               ResultTag,
+		"missing>=0":              ResultTag,
+	}
+	for expr, expect := range cases {
+		p, err := ParseTagPredicate(expr)
+		if err != nil {
+			t.Errorf("unexpected error while parsing %q: %s", expr, err)
+			continue
+		}
+		assert(t, "result of "+expr, p.Filter(msg), expect)
+	}
+}
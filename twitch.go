@@ -0,0 +1,257 @@
+package justgrep
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Badge is an entry of the badges or badge-info tags, like subscriber/12.
+type Badge struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Emote is a single use of an emote in the message text.
+type Emote struct {
+	ID string `json:"id"`
+	// Start and End are [start, end) byte offsets into Text()
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// Name is the text the emote replaces
+	Name string `json:"name"`
+}
+
+// OffsetUnit is what the positions in the emotes tag count.
+type OffsetUnit uint8
+
+const (
+	// CodePoints is what Twitch sends: every Unicode code point counts as one, including emoji
+	CodePoints OffsetUnit = iota
+	// UTF16 counts characters outside the Basic Multilingual Plane as two, like JavaScript strings. Some tools
+	// that synthesize messages use these.
+	UTF16
+)
+
+// Reply is the message a reply was sent to, from the reply-parent-* and reply-thread-parent-* tags.
+type Reply struct {
+	ParentID          string `json:"parent_id"`
+	ParentUserID      string `json:"parent_user_id,omitempty"`
+	ParentLogin       string `json:"parent_login,omitempty"`
+	ParentDisplayName string `json:"parent_display_name,omitempty"`
+	ParentText        string `json:"parent_text,omitempty"`
+	// ThreadID is the id of the first message of the thread
+	ThreadID    string `json:"thread_id,omitempty"`
+	ThreadLogin string `json:"thread_login,omitempty"`
+}
+
+// TwitchFields is the typed view of a message's Twitch tags, as output by irc2json -twitch.
+type TwitchFields struct {
+	Channel      string  `json:"channel,omitempty"`
+	Text         string  `json:"text,omitempty"`
+	IsAction     bool    `json:"is_action,omitempty"`
+	ID           string  `json:"id,omitempty"`
+	UserID       string  `json:"user_id,omitempty"`
+	RoomID       string  `json:"room_id,omitempty"`
+	DisplayName  string  `json:"display_name,omitempty"`
+	MsgID        string  `json:"msg_id,omitempty"`
+	Badges       []Badge `json:"badges,omitempty"`
+	BadgeInfo    []Badge `json:"badge_info,omitempty"`
+	Emotes       []Emote `json:"emotes,omitempty"`
+	Bits         int     `json:"bits,omitempty"`
+	FirstMessage bool    `json:"first_message,omitempty"`
+	Reply        *Reply  `json:"reply,omitempty"`
+}
+
+// Twitch collects all typed accessors into one struct.
+func (m *Message) Twitch() TwitchFields {
+	fields := TwitchFields{
+		Channel:      m.Channel(),
+		Text:         m.Text(),
+		IsAction:     m.IsAction(),
+		ID:           m.Tags["id"],
+		UserID:       m.UserID(),
+		RoomID:       m.RoomID(),
+		DisplayName:  m.Tags["display-name"],
+		MsgID:        m.MsgID(),
+		Badges:       m.Badges(),
+		BadgeInfo:    m.BadgeInfo(),
+		Emotes:       m.Emotes(),
+		Bits:         m.Bits(),
+		FirstMessage: m.IsFirstMessage(),
+	}
+	if reply, ok := m.Reply(); ok {
+		fields.Reply = &reply
+	}
+	return fields
+}
+
+// Channel returns the channel the message was sent to, without the #, or "" if it wasn't sent to one.
+func (m *Message) Channel() string {
+	if len(m.Args) == 0 || !strings.HasPrefix(m.Args[0], "#") {
+		return ""
+	}
+	return m.Args[0][1:]
+}
+
+// Text returns the message text (the last argument after the channel) without the /me wrapping, see IsAction.
+func (m *Message) Text() string {
+	if len(m.Args) < 2 {
+		return ""
+	}
+	text := m.Args[len(m.Args)-1]
+	if m.IsAction() {
+		return strings.TrimSuffix(text[len(actionPrefix):], actionSuffix)
+	}
+	return text
+}
+
+// IsAction reports whether the message was sent with /me. Only PRIVMSGs can be.
+func (m *Message) IsAction() bool {
+	return m.Action == "PRIVMSG" && len(m.Args) >= 2 && strings.HasPrefix(m.Args[len(m.Args)-1], actionPrefix)
+}
+
+func (m *Message) UserID() string {
+	return m.Tags["user-id"]
+}
+
+func (m *Message) RoomID() string {
+	return m.Tags["room-id"]
+}
+
+// MsgID returns the msg-id tag, the kind of USERNOTICE or NOTICE, like "sub" or "raid".
+func (m *Message) MsgID() string {
+	return m.Tags["msg-id"]
+}
+
+// IsFirstMessage reports whether this is the user's first message in the channel.
+func (m *Message) IsFirstMessage() bool {
+	return m.Tags["first-msg"] == "1"
+}
+
+// Bits returns the number of bits cheered with the message, 0 if none or the tag is invalid.
+func (m *Message) Bits() int {
+	bits, err := strconv.Atoi(m.Tags["bits"])
+	if err != nil {
+		return 0
+	}
+	return bits
+}
+
+// Badges parses the badges tag.
+func (m *Message) Badges() []Badge {
+	return parseBadges(m.Tags["badges"])
+}
+
+// BadgeInfo parses the badge-info tag, which has details like the exact number of months subscribed.
+func (m *Message) BadgeInfo() []Badge {
+	return parseBadges(m.Tags["badge-info"])
+}
+
+// HasBadge reports whether the user has a badge with the given name in any version.
+func (m *Message) HasBadge(name string) bool {
+	for _, badge := range m.Badges() {
+		if badge.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBadges(tag string) []Badge {
+	if tag == "" {
+		return nil
+	}
+	var badges []Badge
+	for _, entry := range strings.Split(tag, ",") {
+		if entry == "" {
+			continue
+		}
+		badge := Badge{Name: entry}
+		if idx := strings.Index(entry, "/"); idx != -1 {
+			badge.Name = entry[:idx]
+			badge.Version = entry[idx+1:]
+		}
+		badges = append(badges, badge)
+	}
+	return badges
+}
+
+// Reply returns the message this one replied to, ok is false if it isn't a reply.
+func (m *Message) Reply() (reply Reply, ok bool) {
+	id := m.Tags["reply-parent-msg-id"]
+	if id == "" {
+		return Reply{}, false
+	}
+	return Reply{
+		ParentID:          id,
+		ParentUserID:      m.Tags["reply-parent-user-id"],
+		ParentLogin:       m.Tags["reply-parent-user-login"],
+		ParentDisplayName: m.Tags["reply-parent-display-name"],
+		ParentText:        m.Tags["reply-parent-msg-body"],
+		ThreadID:          m.Tags["reply-thread-parent-msg-id"],
+		ThreadLogin:       m.Tags["reply-thread-parent-user-login"],
+	}, true
+}
+
+// Emotes parses the emotes tag with Twitch's code point positions, see EmotesWith.
+func (m *Message) Emotes() []Emote {
+	return m.EmotesWith(CodePoints)
+}
+
+// EmotesWith parses the emotes tag ("id:start-end,start-end/id:start-end"), reading the positions in unit. The
+// emotes are sorted by their position in Text(), ranges which are invalid or outside of the text are left out.
+func (m *Message) EmotesWith(unit OffsetUnit) []Emote {
+	tag := m.Tags["emotes"]
+	if tag == "" {
+		return nil
+	}
+	text := m.Text()
+	offsets := byteOffsets(text, unit)
+	var emotes []Emote
+	for _, group := range strings.Split(tag, "/") {
+		idx := strings.Index(group, ":")
+		if idx == -1 {
+			continue
+		}
+		id := group[:idx]
+		for _, span := range strings.Split(group[idx+1:], ",") {
+			dash := strings.Index(span, "-")
+			if dash == -1 {
+				continue
+			}
+			start, err := strconv.Atoi(span[:dash])
+			if err != nil {
+				continue
+			}
+			// the end is inclusive
+			end, err := strconv.Atoi(span[dash+1:])
+			if err != nil {
+				continue
+			}
+			end++
+			if start < 0 || end <= start || end >= len(offsets) || offsets[start] == -1 || offsets[end] == -1 {
+				continue
+			}
+			byteStart, byteEnd := offsets[start], offsets[end]
+			emotes = append(emotes, Emote{ID: id, Start: byteStart, End: byteEnd, Name: text[byteStart:byteEnd]})
+		}
+	}
+	sort.Slice(emotes, func(i, j int) bool {
+		return emotes[i].Start < emotes[j].Start
+	})
+	return emotes
+}
+
+// byteOffsets maps positions counted in unit to byte offsets in text. The result has an entry for every position
+// up to and including the end of text, positions in the middle of a surrogate pair are -1.
+func byteOffsets(text string, unit OffsetUnit) []int {
+	offsets := make([]int, 0, len(text)+1)
+	for i, r := range text {
+		offsets = append(offsets, i)
+		if unit == UTF16 && r > 0xffff {
+			offsets = append(offsets, -1)
+		}
+	}
+	return append(offsets, len(text))
+}
@@ -0,0 +1,72 @@
+package justgrep
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMessage_Emotes(t *testing.T) {
+	msg, err := NewMessage("@emotes=25:5-9/1902:13-17,19-23 :a!a@a PRIVMSG #forsen :😀 hi Kappa 😀 Keepo Keepo")
+	assert(t, "err", err, nil)
+	emotes := msg.Emotes()
+	assert(t, "count", len(emotes), 3)
+	assert(t, "first", fmt.Sprint(emotes[0]), "{25 8 13 Kappa}")
+	assert(t, "second", fmt.Sprint(emotes[1]), "{1902 19 24 Keepo}")
+	assert(t, "third", fmt.Sprint(emotes[2]), "{1902 25 30 Keepo}")
+
+	msg, err = NewMessage("@emotes=25:6-10/1902:15-19 :a!a@a PRIVMSG #forsen :😀 hi Kappa 😀 Keepo")
+	assert(t, "err", err, nil)
+	emotes = msg.EmotesWith(UTF16)
+	assert(t, "utf16 count", len(emotes), 2)
+	assert(t, "utf16 first", emotes[0].Name, "Kappa")
+	assert(t, "utf16 second", emotes[1].Name, "Keepo")
+
+	msg, err = NewMessage("@emotes=25:0-4/1:50-60/2:x-1/3 :a!a@a PRIVMSG #forsen :\x01ACTION Kappa\x01")
+	assert(t, "err", err, nil)
+	emotes = msg.Emotes()
+	assert(t, "action count", len(emotes), 1)
+	assert(t, "action", emotes[0].Name, "Kappa")
+}
+
+func TestMessage_Twitch(t *testing.T) {
+	msg, err := NewMessage(
+		"@badge-info=subscriber/14;badges=subscriber/12,glhf-pledge/1;bits=100;first-msg=1;id=abc;" +
+			"reply-parent-display-name=B;reply-parent-msg-body=hello\\sthere;reply-parent-msg-id=def;" +
+			"reply-parent-user-id=6;reply-parent-user-login=b;room-id=1;user-id=5 " +
+			":a!a@a PRIVMSG #forsen :\x01ACTION cheer100\x01",
+	)
+	assert(t, "err", err, nil)
+	assert(t, "channel", msg.Channel(), "forsen")
+	assert(t, "text", msg.Text(), "cheer100")
+	assert(t, "action", msg.IsAction(), true)
+	assert(t, "bits", msg.Bits(), 100)
+	assert(t, "first message", msg.IsFirstMessage(), true)
+	assert(t, "badges", fmt.Sprint(msg.Badges()), "[{subscriber 12} {glhf-pledge 1}]")
+	assert(t, "badge info", fmt.Sprint(msg.BadgeInfo()), "[{subscriber 14}]")
+	assert(t, "has badge", msg.HasBadge("subscriber"), true)
+	assert(t, "doesn't have badge", msg.HasBadge("moderator"), false)
+
+	reply, ok := msg.Reply()
+	assert(t, "is reply", ok, true)
+	assert(t, "reply", fmt.Sprint(reply), "{def 6 b B hello there  }")
+
+	fields := msg.Twitch()
+	assert(t, "fields id", fields.ID, "abc")
+	assert(t, "fields user id", fields.UserID, "5")
+	assert(t, "fields room id", fields.RoomID, "1")
+	assert(t, "fields reply", fields.Reply.ParentID, "def")
+
+	msg, err = NewMessage(":tmi.twitch.tv CLEARCHAT #forsen")
+	assert(t, "err", err, nil)
+	assert(t, "no text", msg.Text(), "")
+	assert(t, "not action", msg.IsAction(), false)
+	_, ok = msg.Reply()
+	assert(t, "not reply", ok, false)
+	assert(t, "no badges", len(msg.Badges()), 0)
+
+	// only PRIVMSGs are actions
+	msg, err = NewMessage(":tmi.twitch.tv NOTICE #forsen :\x01ACTION hi\x01")
+	assert(t, "err", err, nil)
+	assert(t, "notice not action", msg.IsAction(), false)
+	assert(t, "notice text", msg.Text(), "\x01ACTION hi\x01")
+}